@@ -0,0 +1,112 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const authRealm = "cf-rabbitmq-broker"
+
+// Name of the credential set built from the top-level username and password.
+const defaultCredentials = "default"
+
+// A named set of broker credentials. Credential sets with a validity window
+// allow rotation: the old and the new set are both accepted while their
+// windows overlap.
+type credentialSet struct {
+	name      string
+	username  []byte
+	password  []byte
+	notBefore time.Time
+	notAfter  time.Time
+	admin     bool
+}
+
+func (c *credentialSet) activeAt(t time.Time) bool {
+	if !c.notBefore.IsZero() && t.Before(c.notBefore) {
+		return false
+	}
+	if !c.notAfter.IsZero() && t.After(c.notAfter) {
+		return false
+	}
+	return true
+}
+
+type authenticator struct {
+	credentials []credentialSet
+}
+
+func newAuthenticator(o Options) (*authenticator, error) {
+	a := &authenticator{}
+	if o.Username != "" || o.Password != "" {
+		a.credentials = append(a.credentials, credentialSet{
+			name:     defaultCredentials,
+			username: []byte(o.Username),
+			password: []byte(o.Password),
+		})
+	}
+	names := make(map[string]bool)
+	for _, co := range o.Credentials {
+		c := credentialSet{
+			name:     co.Name,
+			username: []byte(co.Username),
+			password: []byte(co.Password),
+			admin:    co.Admin,
+		}
+		if c.name == "" {
+			return nil, errors.New("Broker credentials must be named")
+		}
+		if c.name == defaultCredentials {
+			return nil, fmt.Errorf("Broker credentials name is reserved: [%v]", c.name)
+		}
+		if names[c.name] {
+			return nil, fmt.Errorf("Broker credentials name is not unique: [%v]", c.name)
+		}
+		names[c.name] = true
+		if len(c.username) == 0 || len(c.password) == 0 {
+			return nil, fmt.Errorf("Broker credentials [%v] must define both username and password", c.name)
+		}
+		var err error
+		if c.notBefore, err = parseCredentialTime(co.NotBefore); err != nil {
+			return nil, fmt.Errorf("Broker credentials [%v] have invalid 'notBefore': %v", c.name, err)
+		}
+		if c.notAfter, err = parseCredentialTime(co.NotAfter); err != nil {
+			return nil, fmt.Errorf("Broker credentials [%v] have invalid 'notAfter': %v", c.name, err)
+		}
+		a.credentials = append(a.credentials, c)
+	}
+	if len(a.credentials) == 0 {
+		return nil, errors.New("No broker credentials configured")
+	}
+	return a, nil
+}
+
+// Returns the credential set matching the given username and password.
+// Every configured set is compared in constant time, so the time taken does
+// not reveal which set, if any, matched.
+func (a *authenticator) authenticate(username, password string) (*credentialSet, bool) {
+	now := time.Now()
+	var matched *credentialSet
+	for i := range a.credentials {
+		c := &a.credentials[i]
+		u := subtle.ConstantTimeCompare(c.username, []byte(username))
+		p := subtle.ConstantTimeCompare(c.password, []byte(password))
+		if u&p == 1 && c.activeAt(now) && matched == nil {
+			matched = c
+		}
+	}
+	return matched, matched != nil
+}
+
+func parseCredentialTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,82 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewAuthenticatorRejectsInvalidNames(t *testing.T) {
+	tests := map[string]Options{
+		"unnamed": {Credentials: []CredentialOptions{
+			{Username: "u", Password: "p"},
+		}},
+		"reserved": {Username: "u", Password: "p", Credentials: []CredentialOptions{
+			{Name: "default", Username: "a", Password: "a", Admin: true},
+		}},
+		"reserved without top-level credentials": {Credentials: []CredentialOptions{
+			{Name: "default", Username: "a", Password: "a"},
+		}},
+		"duplicate": {Credentials: []CredentialOptions{
+			{Name: "ops", Username: "a", Password: "a", Admin: true},
+			{Name: "ops", Username: "u", Password: "p"},
+		}},
+		"incomplete": {Credentials: []CredentialOptions{
+			{Name: "ops", Username: "a"},
+		}},
+		"invalid notAfter": {Credentials: []CredentialOptions{
+			{Name: "ops", Username: "a", Password: "a", NotAfter: "tomorrow"},
+		}},
+		"none": {},
+	}
+	for name, o := range tests {
+		if _, err := newAuthenticator(o); err == nil {
+			t.Errorf("%v: newAuthenticator succeeded", name)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	a, err := newAuthenticator(Options{
+		Username: "cc",
+		Password: "secret",
+		Credentials: []CredentialOptions{
+			{Name: "ops", Username: "admin", Password: "admin-secret", Admin: true},
+			{Name: "old", Username: "cc", Password: "old-secret", NotAfter: past},
+			{Name: "next", Username: "cc", Password: "next-secret", NotBefore: future},
+			{Name: "shared", Username: "admin", Password: "shared-secret"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username, password string
+		name               string
+		admin              bool
+	}{
+		{"cc", "secret", "default", false},
+		{"admin", "admin-secret", "ops", true},
+		{"admin", "shared-secret", "shared", false},
+		{"cc", "old-secret", "", false},
+		{"cc", "next-secret", "", false},
+		{"cc", "admin-secret", "", false},
+		{"", "", "", false},
+	}
+	for _, test := range tests {
+		c, ok := a.authenticate(test.username, test.password)
+		if ok != (test.name != "") {
+			t.Errorf("authenticate(%q, %q) = %v; want %v", test.username, test.password, ok, !ok)
+			continue
+		}
+		if ok && (c.name != test.name || c.admin != test.admin) {
+			t.Errorf("authenticate(%q, %q) matched [%v], admin %v; want [%v], admin %v", test.username, test.password, c.name, c.admin, test.name, test.admin)
+		}
+	}
+}
@@ -5,38 +5,159 @@
 package broker
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 )
 
+var brokerLog = NewLogger("Broker")
+
+const defaultShutdownTimeout = 30 * time.Second
+
 type broker struct {
-	opts   Options
-	router *router
+	opts      Options
+	handler   *handler
+	router    *router
+	logFile   *logFile
+	tlsConfig *tls.Config
+	certs     *certReloader
+}
+
+func New(o Options, bs []BrokerService) (*broker, error) {
+	logFile, err := configureLogging(o)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := newAuthenticator(o)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, certs, err := newTLSConfig(o)
+	if err != nil {
+		return nil, err
+	}
+	store, err := openStateStore(o)
+	if err != nil {
+		return nil, err
+	}
+	d := newDashboard(o, bs, store)
+	h := newHandler(bs, store, d)
+	if err := h.resumeRetirements(); err != nil {
+		return nil, fmt.Errorf("Cannot resume credential retirements: %v", err)
+	}
+	return &broker{o, h, newRouter(o, auth, h, d), logFile, tlsConfig, certs}, nil
 }
 
-func New(o Options, bs []BrokerService) *broker {
-	return &broker{o, newRouter(o, newHandler(bs))}
+func openStateStore(o Options) (StateStore, error) {
+	if o.StateFile == "" {
+		brokerLog.Printf("No state file configured; state is kept in memory only")
+		return NewMemoryStore(), nil
+	}
+	store, err := NewFileStore(o.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open state file '%v': %v", o.StateFile, err)
+	}
+	return store, nil
 }
 
-func (b *broker) Start() {
+// Serves requests until the broker is shut down by a signal. Returns an
+// error if it cannot start or stops serving for any other reason.
+func (b *broker) Start() error {
+	if b.opts.PidFile != "" {
+		if err := writePidFile(b.opts.PidFile); err != nil {
+			return fmt.Errorf("Cannot write pid file '%v': %v", b.opts.PidFile, err)
+		}
+		defer os.Remove(b.opts.PidFile)
+	}
+
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	addr := fmt.Sprintf("%v:%v", b.opts.Host, b.opts.Port)
+	server := &http.Server{Addr: addr, Handler: b.router, TLSConfig: b.tlsConfig}
 
 	errCh := make(chan error, 1)
 	go func() {
-		addr := fmt.Sprintf("%v:%v", b.opts.Host, b.opts.Port)
-		log.Printf("Broker started: Listening at [%v]", addr)
-		errCh <- http.ListenAndServe(addr, b.router)
+		if b.tlsConfig != nil {
+			brokerLog.Printf("Started: Listening at [%v] using TLS", addr)
+			errCh <- server.ListenAndServeTLS("", "")
+		} else {
+			brokerLog.Printf("Started: Listening at [%v]", addr)
+			errCh <- server.ListenAndServe()
+		}
 	}()
 
-	select {
-	case err := <-errCh:
-		log.Printf("Broker shutdown with error: %v", err)
-	case sig := <-sigCh:
-		var _ = sig
-		log.Print("Broker shutdown gracefully")
+	for {
+		select {
+		case err := <-errCh:
+			brokerLog.Errorf("Shutdown with error: %v", err)
+			return err
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				b.reopenLogFile()
+				b.reloadCertificates()
+				continue
+			}
+			b.shutdown(server, sig)
+			return nil
+		}
+	}
+}
+
+// Stops accepting requests and waits until in-flight requests and background
+// operations finish or the shutdown timeout expires. Operations still
+// running then are aborted and rolled back before the broker exits.
+func (b *broker) shutdown(server *http.Server, sig os.Signal) {
+	timeout := defaultShutdownTimeout
+	if b.opts.ShutdownTimeout > 0 {
+		timeout = time.Duration(b.opts.ShutdownTimeout) * time.Second
+	}
+	brokerLog.Printf("Received %v: Draining in-flight operations for up to %v", sig, timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	serverErr := server.Shutdown(ctx)
+	if serverErr != nil {
+		brokerLog.Errorf("Shutdown before all requests finished: %v", serverErr)
+	}
+	if err := b.handler.drain(ctx); err != nil {
+		brokerLog.Errorf("Shutdown before all operations finished; unfinished ones aborted: %v", err)
+		return
+	}
+	if serverErr == nil {
+		brokerLog.Printf("Shutdown gracefully")
+	}
+}
+
+func (b *broker) reopenLogFile() {
+	if b.logFile == nil {
+		return
+	}
+	if err := b.logFile.reopen(); err != nil {
+		brokerLog.Errorf("Cannot reopen log file '%v': %v", b.opts.LogFile, err)
+		return
+	}
+	brokerLog.Printf("Log file reopened: [%v]", b.opts.LogFile)
+}
+
+func (b *broker) reloadCertificates() {
+	if b.certs == nil {
+		return
+	}
+	if err := b.certs.reload(); err != nil {
+		brokerLog.Errorf("Cannot reload TLS certificate; keeping the current one: %v", err)
+		return
 	}
+	brokerLog.Printf("TLS certificate reloaded: [%v]", b.opts.TLSCertFile)
+}
+
+func writePidFile(path string) error {
+	return ioutil.WriteFile(path, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0644)
 }
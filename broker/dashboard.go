@@ -0,0 +1,287 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var dashboardLog = NewLogger("Dashboard")
+
+const (
+	dashboardPrefix       = "/dashboard/"
+	sessionCookie         = "dashboard_session"
+	stateCookie           = "dashboard_state"
+	dashboardScopes       = "openid cloud_controller_service_permissions.read"
+	authorizationTimeout  = 10 * time.Minute
+	defaultSessionTimeout = time.Hour
+)
+
+var (
+	dashboardUrlPattern         = fmt.Sprintf("%v{%v}", dashboardPrefix, instanceId)
+	dashboardCallbackUrlPattern = dashboardPrefix + "callback"
+)
+
+// Dashboard single sign-on. See
+// http://docs.cloudfoundry.org/services/dashboard-sso.html
+//
+// The dashboard URL advertised for an instance points at the broker, which
+// lets the user sign on with UAA and asks the Cloud Controller whether they
+// may manage the instance. Only then does it proxy the management UI, see
+// proxy.go.
+type dashboard struct {
+	opts     Options
+	services []BrokerService
+	store    StateStore
+	sessions *sessions
+	states   *sessions // Pending authorizations by OAuth2 state
+	client   *http.Client
+}
+
+// Returns nil unless single sign-on is configured.
+func newDashboard(o Options, bs []BrokerService, s StateStore) *dashboard {
+	if o.ExternalUrl == "" || o.UaaUrl == "" || o.CloudControllerUrl == "" {
+		return nil
+	}
+	return &dashboard{
+		opts:     o,
+		services: bs,
+		store:    s,
+		sessions: newSessions(),
+		states:   newSessions(),
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Returns the dashboard URL of an instance, or an empty string if single
+// sign-on is not configured for its service.
+func (d *dashboard) url(instanceId, serviceId string) string {
+	if d == nil || d.dashboardClient(serviceId) == nil {
+		return ""
+	}
+	return d.externalUrl(dashboardPrefix + url.PathEscape(instanceId))
+}
+
+// Opens the proxied management UI if the user has a session for the
+// instance; otherwise starts the authorization.
+func (d *dashboard) show(w http.ResponseWriter, req *http.Request) {
+	iid := mux.Vars(req)[instanceId]
+	_, dc, ok := d.lookup(w, iid)
+	if !ok {
+		return
+	}
+
+	if d.hasSession(req, iid) {
+		http.Redirect(w, req, dashboardPrefix+url.PathEscape(iid)+"/", http.StatusFound)
+		return
+	}
+
+	state := d.states.create(iid, authorizationTimeout)
+	http.SetCookie(w, d.cookie(stateCookie, state, dashboardPrefix, authorizationTimeout))
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {dc.Id},
+		"redirect_uri":  {d.redirectUri(dc)},
+		"scope":         {dashboardScopes},
+		"state":         {state},
+	}
+	http.Redirect(w, req, d.uaaUrl("/oauth/authorize")+"?"+query.Encode(), http.StatusFound)
+}
+
+// Completes the authorization and opens a session for the instance if the
+// user may manage it.
+func (d *dashboard) callback(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	c, err := req.Cookie(stateCookie)
+	if err != nil || c.Value != query.Get("state") {
+		http.Error(w, "Invalid authorization state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, d.cookie(stateCookie, "", dashboardPrefix, -1))
+	iid, ok := d.states.take(c.Value)
+	if !ok {
+		http.Error(w, "Authorization expired", http.StatusBadRequest)
+		return
+	}
+	if e := query.Get("error"); e != "" {
+		dashboardLog.Printf("Authorization denied for service instance [%v]: %v", iid, e)
+		http.Error(w, "Authorization denied", http.StatusForbidden)
+		return
+	}
+
+	_, dc, ok := d.lookup(w, iid)
+	if !ok {
+		return
+	}
+	token, err := d.accessToken(dc, query.Get("code"))
+	if err != nil {
+		dashboardLog.Errorf("Cannot obtain access token for service instance [%v]: %v", iid, err)
+		http.Error(w, "Cannot obtain access token", http.StatusBadGateway)
+		return
+	}
+	allowed, err := d.canManage(token, iid)
+	if err != nil {
+		dashboardLog.Errorf("Cannot check permissions for service instance [%v]: %v", iid, err)
+		http.Error(w, "Cannot check permissions", http.StatusBadGateway)
+		return
+	}
+	if !allowed {
+		dashboardLog.Printf("Dashboard access refused: [%v]", iid)
+		http.Error(w, "Not authorized to manage this service instance", http.StatusForbidden)
+		return
+	}
+
+	timeout := defaultSessionTimeout
+	if d.opts.SessionTimeout > 0 {
+		timeout = time.Duration(d.opts.SessionTimeout) * time.Minute
+	}
+	path := dashboardPrefix + url.PathEscape(iid)
+	http.SetCookie(w, d.cookie(sessionCookie, d.sessions.create(iid, timeout), path, timeout))
+	dashboardLog.Printf("Dashboard session opened: [%v]", iid)
+	http.Redirect(w, req, path, http.StatusFound)
+}
+
+func (d *dashboard) hasSession(req *http.Request, iid string) bool {
+	c, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return false
+	}
+	id, ok := d.sessions.get(c.Value)
+	return ok && id == iid
+}
+
+// Finds the instance and the dashboard client of its service, answering
+// with 404 Not Found if either is missing.
+func (d *dashboard) lookup(w http.ResponseWriter, iid string) (*Instance, *DashboardClient, bool) {
+	instance, err := d.store.GetInstance(iid)
+	if err != nil {
+		dashboardLog.Errorf("Cannot look up service instance [%v]: %v", iid, err)
+		http.Error(w, "Cannot look up service instance", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	if instance == nil {
+		http.Error(w, "Unknown service instance", http.StatusNotFound)
+		return nil, nil, false
+	}
+	dc := d.dashboardClient(instance.ServiceId)
+	if dc == nil {
+		http.Error(w, "Service instance has no dashboard", http.StatusNotFound)
+		return nil, nil, false
+	}
+	return instance, dc, true
+}
+
+func (d *dashboard) dashboardClient(serviceId string) *DashboardClient {
+	cat, err := d.services[0].Catalog()
+	if err != nil {
+		return nil
+	}
+	for _, s := range cat.Services {
+		if s.Id == serviceId {
+			return s.DashboardClient
+		}
+	}
+	return nil
+}
+
+// Exchanges the authorization code for an access token.
+func (d *dashboard) accessToken(dc *DashboardClient, code string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {d.redirectUri(dc)},
+	}
+	req, err := http.NewRequest("POST", d.uaaUrl("/oauth/token"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(dc.Id, dc.Secret)
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if _, err := d.do(req, &token); err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("No access token received")
+	}
+	return token.AccessToken, nil
+}
+
+// Asks the Cloud Controller whether the token's user may manage the instance.
+func (d *dashboard) canManage(token, iid string) (bool, error) {
+	ccUrl := fmt.Sprintf("%v/v2/service_instances/%v/permissions", strings.TrimRight(d.opts.CloudControllerUrl, "/"), url.PathEscape(iid))
+	req, err := http.NewRequest("GET", ccUrl, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+
+	var permissions struct {
+		Manage bool `json:"manage"`
+	}
+	if status, err := d.do(req, &permissions); status == http.StatusForbidden || status == http.StatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return permissions.Manage, nil
+}
+
+// Sends the request and decodes the JSON response into v.
+func (d *dashboard) do(req *http.Request, v interface{}) (int, error) {
+	req.Header.Set("Accept", "application/json")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("%v %v: %v", req.Method, req.URL.Path, resp.Status)
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (d *dashboard) redirectUri(dc *DashboardClient) string {
+	if dc.RedirectUri != "" {
+		return dc.RedirectUri
+	}
+	return d.externalUrl(dashboardCallbackUrlPattern)
+}
+
+func (d *dashboard) externalUrl(path string) string {
+	return strings.TrimRight(d.opts.ExternalUrl, "/") + path
+}
+
+func (d *dashboard) uaaUrl(path string) string {
+	return strings.TrimRight(d.opts.UaaUrl, "/") + path
+}
+
+// Creates a cookie which is deleted when ttl is negative.
+func (d *dashboard) cookie(name, value, path string, ttl time.Duration) *http.Cookie {
+	maxAge := int(ttl.Seconds())
+	if ttl < 0 {
+		maxAge = -1
+	}
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		Secure:   strings.HasPrefix(d.opts.ExternalUrl, "https:"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Returns a StateStore kept in memory and written to the given JSON file
+// after every change. The file is replaced atomically, so a crash never
+// leaves it half-written, and is readable by its owner only as it holds
+// binding credentials.
+func NewFileStore(path string) (StateStore, error) {
+	state := newStoreState()
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, err
+		}
+		if state.Instances == nil {
+			state.Instances = make(map[string]Instance)
+		}
+		if state.Bindings == nil {
+			state.Bindings = make(map[string]Binding)
+		}
+	}
+	return &memoryStore{state: state, persist: writeStateFile(path)}, nil
+}
+
+func writeStateFile(path string) func(storeState) error {
+	return func(state storeState) error {
+		data, err := json.MarshalIndent(state, "", "  ")
+		if err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), path)
+	}
+}
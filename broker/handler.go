@@ -5,30 +5,91 @@
 package broker
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/mux"
-	"log"
 	"net/http"
+	"sync"
+	"time"
 )
 
 var empty struct{} = struct{}{}
 
+var handlerLog = NewLogger("Handler")
+
 type handler struct {
 	brokerServices []BrokerService
+	store          StateStore
+	dashboard      *dashboard // Nil unless dashboard single sign-on is configured
+	operations     *operations
+	locks          *recordLocks
+	running        sync.WaitGroup // Operations on the zones still running
+	mu             sync.Mutex     // Guards draining and registrations with running
+	draining       bool
+	ctx            context.Context // Done when operations must be aborted
+	abort          context.CancelFunc
+}
+
+func newHandler(bs []BrokerService, s StateStore, d *dashboard) *handler {
+	ctx, abort := context.WithCancel(context.Background())
+	return &handler{
+		brokerServices: bs,
+		store:          s,
+		dashboard:      d,
+		operations:     newOperations(),
+		locks:          newRecordLocks(),
+		ctx:            ctx,
+		abort:          abort,
+	}
 }
 
-func newHandler(bs []BrokerService) *handler {
-	return &handler{bs}
+// Registers an operation on the zones, so drain waits for it. Returns false
+// once the broker is draining; no new operations are started then.
+func (h *handler) begin() (end func(), ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.draining {
+		return nil, false
+	}
+	h.running.Add(1)
+	return h.running.Done, true
+}
+
+// Refuses new operations and waits until the running ones have finished.
+// When ctx is done first, the remaining ones are aborted: operations which
+// must be done in all zones roll back the zones done so far, and asynchronous
+// provisioning is reported as failed.
+func (h *handler) drain(ctx context.Context) error {
+	h.mu.Lock()
+	h.draining = true
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		h.abort()
+		<-done
+		return ctx.Err()
+	}
 }
 
 func (h *handler) catalog(r *http.Request) responseEntity {
 
-	log.Printf("Handler: Requesting catalog")
+	handlerLog.Debugf("Requesting catalog")
 
 	if cat, err := h.brokerServices[0].Catalog(); err != nil {
 		return handleServiceError(err)
 	} else {
-		log.Printf("Handler: Catalog retrieved")
+		handlerLog.Debugf("Catalog retrieved")
 
 		return responseEntity{http.StatusOK, cat}
 	}
@@ -38,44 +99,214 @@ func (h *handler) provision(req *http.Request) responseEntity {
 	vars := mux.Vars(req)
 	preq := ProvisioningRequest{InstanceId: vars[instanceId]}
 
-	log.Printf("Handler: Provisioning: %v", preq)
+	handlerLog.Printf("Provisioning: %v", preq)
+
+	end, ok := h.begin()
+	if !ok {
+		return h.shuttingDown()
+	}
+	defer end()
 
 	if err := json.NewDecoder(req.Body).Decode(&preq); err != nil {
-		handleDecodingError(err)
+		return handleDecodingError(err)
 	}
 
-	log.Printf("Handler: Provisioning request decoded: %v", preq)
+	handlerLog.Debugf("Provisioning request decoded: %v", preq)
 
-	var url string
-	var err error
+	if instance, err := h.recordedInstance(preq); err != nil {
+		return handleServiceError(err)
+	} else if instance != nil {
+		return h.provisioned(http.StatusOK, instance)
+	}
 
-	for _, brokerService := range h.brokerServices {
-		url, err = brokerService.Provision(preq)
-		if err != nil {
-			return handleServiceError(err)
+	// Asynchronous provisioning was introduced in Service Broker API 2.7
+	async := acceptsIncomplete(req) && requestApiVersion(req).atLeast(2, 7)
+	if op, ok := h.operations.get(preq.InstanceId); ok && op.State == stateInProgress {
+		if !async {
+			return h.inProgress(preq.InstanceId)
 		}
+		// A replayed request; the instance is still being provisioned
+		handlerLog.Printf("Already provisioning [%v]: %v", op.Id, preq)
+		return responseEntity{http.StatusAccepted, struct {
+			Operation string `json:"operation"`
+		}{op.Id}}
 	}
 
-	log.Printf("Handler: Provisioned: %v", preq)
+	if async {
+		endAsync, ok := h.begin()
+		if !ok {
+			return h.shuttingDown()
+		}
+		op, ok := h.operations.start(preq.InstanceId, "Provisioning service instance")
+		if !ok {
+			endAsync()
+			return h.inProgress(preq.InstanceId)
+		}
+		go func() {
+			defer endAsync()
+			_, _, err := h.provisionAll(preq)
+			h.operations.finish(preq.InstanceId, "Service instance provisioned", err)
+			handlerLog.Printf("Asynchronous provisioning [%v] finished: %v", op.Id, preq)
+		}()
+
+		handlerLog.Printf("Provisioning asynchronously [%v]: %v", op.Id, preq)
+
+		return responseEntity{http.StatusAccepted, struct {
+			Operation string `json:"operation"`
+		}{op.Id}}
+	}
 
-	return responseEntity{http.StatusCreated, struct {
-		DashboardUrl string `json:"dashboard_url"`
-	}{url}}
+	instance, created, err := h.provisionAll(preq)
+	if err != nil {
+		return handleServiceError(err)
+	} else if created {
+		return h.provisioned(http.StatusCreated, instance)
+	}
+	return h.provisioned(http.StatusOK, instance)
 }
 
-func (h *handler) deprovision(req *http.Request) responseEntity {
+func (h *handler) provisioned(status int, instance *Instance) responseEntity {
+	if status == http.StatusOK {
+		handlerLog.Printf("Already provisioned: [%v]", instance.Id)
+	}
+	return responseEntity{status, struct {
+		DashboardUrl string `json:"dashboard_url,omitempty"`
+	}{h.dashboard.url(instance.Id, instance.ServiceId)}}
+}
+
+// Returns the recorded instance if there is one. Fails with a conflict if it
+// was provisioned with different attributes.
+func (h *handler) recordedInstance(preq ProvisioningRequest) (*Instance, error) {
+	instance, err := h.store.GetInstance(preq.InstanceId)
+	if err != nil || instance == nil {
+		return nil, err
+	}
+	if !instance.matches(preq) {
+		msg := fmt.Sprintf("Service instance already exists with different attributes: [%v]", preq.InstanceId)
+		return nil, conflictError(msg)
+	}
+	return instance, nil
+}
+
+// Provisions the instance in every zone and records it. Returns the
+// recorded instance and whether it was created; an identical request may
+// have provisioned it meanwhile.
+func (h *handler) provisionAll(preq ProvisioningRequest) (*Instance, bool, error) {
+	unlock := h.locks.instance(preq.InstanceId)
+	defer unlock()
+
+	if instance, err := h.recordedInstance(preq); err != nil || instance != nil {
+		return instance, false, err
+	}
+
+	var mgmt *Management
+
+	deprovision := func(bs BrokerService) error { return bs.Deprovision(preq, []int{0}) }
+	err := inAllZones(h.ctx, "Provisioning", h.brokerServices, func(bs BrokerService) error {
+		m, err := bs.Provision(preq)
+		if bs == h.brokerServices[0] {
+			mgmt = m // The dashboard leads to the primary zone
+		}
+		return err
+	}, deprovision)
+	if err != nil {
+		handlerLog.Errorf("Provisioning failed: %v", preq)
+		return nil, false, err
+	}
+
+	handlerLog.Printf("Provisioned: %v", preq)
+
+	instance := Instance{
+		Id:         preq.InstanceId,
+		ServiceId:  preq.ServiceId,
+		PlanId:     preq.PlanId,
+		OrgId:      preq.OrgId,
+		SpaceId:    preq.SpaceId,
+		Zones:      h.zones(),
+		Management: mgmt,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := h.store.PutInstance(instance); err != nil {
+		handlerLog.Errorf("Cannot record service instance: %v", err)
+		e := &zoneError{op: "Provisioning", failures: []zoneFailure{{"broker", err}}}
+		e.compensate(h.brokerServices, deprovision)
+		return nil, false, e
+	}
+
+	return &instance, true, nil
+}
+
+func (h *handler) lastOperation(req *http.Request) responseEntity {
 	vars := mux.Vars(req)
-	preq := ProvisioningRequest{InstanceId: vars[instanceId]}
+	iid := vars[instanceId]
 
-	log.Printf("Handler: Deprovisioning: %v", preq)
+	handlerLog.Debugf("Polling last operation: [%v]", iid)
 
-	for _, brokerService := range h.brokerServices {
-		if err := brokerService.Deprovision(preq); err != nil {
+	op, ok := h.operations.get(iid)
+	if !ok {
+		// Operations are forgotten on restart, but a recorded instance was
+		// provisioned successfully
+		instance, err := h.store.GetInstance(iid)
+		if err != nil {
 			return handleServiceError(err)
+		} else if instance == nil {
+			return responseEntity{http.StatusGone, empty}
 		}
+		return responseEntity{http.StatusOK, operation{State: stateSucceeded, Description: "Service instance provisioned"}}
+	}
+	if id := req.URL.Query().Get("operation"); id != "" && id != op.Id {
+		msg := fmt.Sprintf("Unknown operation [%v] for service instance [%v]", id, iid)
+		return responseEntity{http.StatusBadRequest, BrokerError{msg}}
+	}
+	return responseEntity{http.StatusOK, op}
+}
+
+func (h *handler) deprovision(req *http.Request) responseEntity {
+	vars := mux.Vars(req)
+	preq := ProvisioningRequest{InstanceId: vars[instanceId]}
+
+	handlerLog.Printf("Deprovisioning: %v", preq)
+
+	end, ok := h.begin()
+	if !ok {
+		return h.shuttingDown()
 	}
+	defer end()
 
-	log.Printf("Handler: Deprovisioned: %v", preq)
+	if op, ok := h.operations.get(preq.InstanceId); ok && op.State == stateInProgress {
+		return h.inProgress(preq.InstanceId)
+	}
+
+	unlock := h.locks.instance(preq.InstanceId)
+	defer unlock()
+
+	instance, err := h.store.GetInstance(preq.InstanceId)
+	if err != nil {
+		return handleServiceError(err)
+	}
+	generations := []int{0}
+	if instance != nil {
+		generations = userGenerations(instance.Generation, instance.Retiring)
+	}
+	err = inEachZone("Deprovisioning", h.brokerServices, func(bs BrokerService) error {
+		return bs.Deprovision(preq, generations)
+	})
+	// Zones the instance is already gone from count as deprovisioned, unless
+	// it is gone everywhere and unknown to the broker.
+	if err != nil && (instance != nil || !isGone(err)) {
+		err = ignoreGone(err)
+	}
+	if err != nil {
+		return handleServiceError(err)
+	}
+
+	h.operations.forget(preq.InstanceId)
+	if err := h.store.DeleteInstance(preq.InstanceId); err != nil {
+		handlerLog.Errorf("Cannot remove service instance record: %v", err)
+		return handleServiceError(err)
+	}
+
+	handlerLog.Printf("Deprovisioned: %v", preq)
 
 	return responseEntity{http.StatusOK, empty}
 }
@@ -84,69 +315,211 @@ func (h *handler) bind(req *http.Request) responseEntity {
 	vars := mux.Vars(req)
 	breq := BindingRequest{InstanceId: vars[instanceId], BindingId: vars[bindingId]}
 
-	log.Printf("Handler: Binding: %v", breq)
+	handlerLog.Printf("Binding: %v", breq)
+
+	end, ok := h.begin()
+	if !ok {
+		return h.shuttingDown()
+	}
+	defer end()
 
 	if err := json.NewDecoder(req.Body).Decode(&breq); err != nil {
-		handleDecodingError(err)
+		return handleDecodingError(err)
 	}
 
-	log.Printf("Handler: Binding request decoded: %v", breq)
+	handlerLog.Debugf("Binding request decoded: %v", breq)
+
+	// The instance is locked too, so it cannot be deprovisioned meanwhile
+	unlockInstance := h.locks.instance(breq.InstanceId)
+	defer unlockInstance()
+	unlock := h.locks.binding(breq.BindingId)
+	defer unlock()
+
+	if binding, err := h.store.GetBinding(breq.BindingId); err != nil {
+		return handleServiceError(err)
+	} else if binding != nil {
+		if !binding.matches(breq) {
+			msg := fmt.Sprintf("Binding already exists with different attributes: [%v]", breq.BindingId)
+			return responseEntity{http.StatusConflict, BrokerError{msg}}
+		}
+		handlerLog.Printf("Already bound: %v", breq)
+		return responseEntity{http.StatusOK, h.bindingEntity(binding.Credentials, binding.SyslogDrainUrl)}
+	}
 
 	zoneCreds := make(map[string]Credentials)
-	var zone string
 	var url string
-	var cred Credentials
-	var err error
 
-	for _, brokerService := range h.brokerServices {
-		zone, cred, url, err = brokerService.Bind(breq)
+	unbind := func(bs BrokerService) error { return bs.Unbind(breq, []int{0}) }
+	err := inAllZones(h.ctx, "Binding", h.brokerServices, func(bs BrokerService) error {
+		zone, cred, drainUrl, err := bs.Bind(breq)
 		if err != nil {
-			return handleServiceError(err)
+			return err
 		}
-		zoneCreds[zone] = cred
+		zoneCreds[zone], url = cred, drainUrl
+		return nil
+	}, unbind)
+	if err != nil {
+		return handleServiceError(err)
+	}
+
+	handlerLog.Printf("Bound: %v", breq)
+
+	binding := Binding{
+		Id:             breq.BindingId,
+		InstanceId:     breq.InstanceId,
+		ServiceId:      breq.ServiceId,
+		PlanId:         breq.PlanId,
+		AppId:          breq.AppId,
+		Zones:          h.zones(),
+		Credentials:    zoneCreds,
+		SyslogDrainUrl: url,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if err := h.store.PutBinding(binding); err != nil {
+		handlerLog.Errorf("Cannot record binding: %v", err)
+		e := &zoneError{op: "Binding", failures: []zoneFailure{{"broker", err}}}
+		e.compensate(h.brokerServices, unbind)
+		return handleServiceError(e)
 	}
 
-	log.Printf("Handler: Bound: %v", breq)
+	return responseEntity{http.StatusCreated, h.bindingEntity(zoneCreds, url)}
+}
 
-	return responseEntity{http.StatusCreated, struct {
+// Credentials are keyed by zone name. The primary (first) zone's
+// credentials are also copied to the top level, so single-zone apps can use
+// them without knowing about zones.
+func (h *handler) bindingEntity(zoneCreds map[string]Credentials, url string) interface{} {
+	return struct {
 		Credentials    interface{} `json:"credentials"`
-		SyslogDrainUrl string      `json:"syslog_drain_url "`
-	}{zoneCreds, url}}
+		SyslogDrainUrl string      `json:"syslog_drain_url,omitempty"`
+	}{h.bindingCredentials(zoneCreds), url}
+}
+
+func (h *handler) bindingCredentials(zoneCreds map[string]Credentials) Credentials {
+	creds := Credentials{}
+	for k, v := range zoneCreds[h.brokerServices[0].Zone()] {
+		creds[k] = v
+	}
+	for zone, cred := range zoneCreds {
+		creds[zone] = cred
+	}
+	return creds
 }
 
 func (h *handler) unbind(req *http.Request) responseEntity {
 	vars := mux.Vars(req)
 	breq := BindingRequest{InstanceId: vars[instanceId], BindingId: vars[bindingId]}
 
-	log.Printf("Handler: Unbinding: %v", breq)
+	handlerLog.Printf("Unbinding: %v", breq)
 
-	for _, brokerService := range h.brokerServices {
-		if err := brokerService.Unbind(breq); err != nil {
-			return handleServiceError(err)
-		}
+	end, ok := h.begin()
+	if !ok {
+		return h.shuttingDown()
 	}
+	defer end()
 
-	log.Printf("Handler: Unbound: %v", breq)
+	// The instance is locked too, so it cannot be deprovisioned meanwhile
+	unlockInstance := h.locks.instance(breq.InstanceId)
+	defer unlockInstance()
+	unlock := h.locks.binding(breq.BindingId)
+	defer unlock()
+
+	binding, err := h.store.GetBinding(breq.BindingId)
+	if err != nil {
+		return handleServiceError(err)
+	}
+	generations := []int{0}
+	if binding != nil {
+		generations = userGenerations(binding.Generation, binding.Retiring)
+	}
+	err = inEachZone("Unbinding", h.brokerServices, func(bs BrokerService) error {
+		return bs.Unbind(breq, generations)
+	})
+	// Zones the binding is already gone from count as unbound, unless it is
+	// gone everywhere and unknown to the broker.
+	if err != nil && (binding != nil || !isGone(err)) {
+		err = ignoreGone(err)
+	}
+	if err != nil {
+		return handleServiceError(err)
+	}
+
+	if err := h.store.DeleteBinding(breq.BindingId); err != nil {
+		handlerLog.Errorf("Cannot remove binding record: %v", err)
+		return handleServiceError(err)
+	}
+
+	handlerLog.Printf("Unbound: %v", breq)
 
 	return responseEntity{http.StatusOK, empty}
 }
 
+// Error of a request conflicting with a recorded instance or binding.
+type conflictError string
+
+func (e conflictError) Code() int {
+	return ErrCodeConflict
+}
+
+func (e conflictError) Error() string {
+	return string(e)
+}
+
+// Answers requests arriving while the broker shuts down.
+func (h *handler) shuttingDown() responseEntity {
+	return responseEntity{http.StatusServiceUnavailable, BrokerError{"Broker is shutting down"}}
+}
+
+// Answers requests for an instance which is still being provisioned.
+func (h *handler) inProgress(iid string) responseEntity {
+	msg := fmt.Sprintf("Another operation is in progress for service instance [%v]", iid)
+	return responseEntity{http.StatusUnprocessableEntity, BrokerError{msg}}
+}
+
+func (h *handler) zones() []string {
+	zones := make([]string, len(h.brokerServices))
+	for i, brokerService := range h.brokerServices {
+		zones[i] = brokerService.Zone()
+	}
+	return zones
+}
+
+func acceptsIncomplete(req *http.Request) bool {
+	return req.URL.Query().Get("accepts_incomplete") == "true"
+}
+
 func handleDecodingError(err error) responseEntity {
-	log.Printf("Handler: Decoding error: %v", err)
+	handlerLog.Errorf("Decoding error: %v", err)
 	return responseEntity{http.StatusBadRequest, BrokerError{err.Error()}}
 }
 
 func handleServiceError(err error) responseEntity {
-	log.Printf("Handler: Service error: %v", err)
+	handlerLog.Errorf("Service error: %v", err)
 
 	switch err := err.(type) {
+	case *zoneError:
+		return responseEntity{statusOf(err.Code()), err.entity()}
 	case BrokerServiceError:
 		switch err.Code() {
 		case ErrCodeConflict:
-			return responseEntity{http.StatusConflict, empty}
+			return responseEntity{http.StatusConflict, BrokerError{err.Error()}}
 		case ErrCodeGone:
 			return responseEntity{http.StatusGone, empty}
+		case ErrCodeBadRequest:
+			return responseEntity{http.StatusBadRequest, BrokerError{err.Error()}}
 		}
 	}
 	return responseEntity{http.StatusInternalServerError, BrokerError{err.Error()}}
 }
+
+func statusOf(code int) int {
+	switch code {
+	case ErrCodeConflict:
+		return http.StatusConflict
+	case ErrCodeGone:
+		return http.StatusGone
+	case ErrCodeBadRequest:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
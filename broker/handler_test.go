@@ -0,0 +1,312 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (z *fakeZone) call(format string, v ...interface{}) error {
+	call := fmt.Sprintf(format, v...)
+	if z.gate != nil {
+		if z.entered != nil {
+			z.entered <- call
+		}
+		<-z.gate
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.calls = append(z.calls, call)
+	if strings.HasPrefix(call, "Provision ") || strings.HasPrefix(call, "Bind ") {
+		return z.err
+	}
+	return nil
+}
+
+func (z *fakeZone) called() []string {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return append([]string(nil), z.calls...)
+}
+
+func (z *fakeZone) Provision(pr ProvisioningRequest) (*Management, error) {
+	if err := z.call("Provision %v", pr.InstanceId); err != nil {
+		return nil, err
+	}
+	return &Management{Url: "http://" + z.name, Username: "m-" + pr.InstanceId, Password: "p"}, nil
+}
+
+func (z *fakeZone) Deprovision(pr ProvisioningRequest, generations []int) error {
+	return z.call("Deprovision %v", pr.InstanceId)
+}
+
+func (z *fakeZone) Bind(br BindingRequest) (string, Credentials, string, error) {
+	if err := z.call("Bind %v", br.BindingId); err != nil {
+		return "", nil, "", err
+	}
+	return z.name, Credentials{"username": "u-" + br.BindingId}, "", nil
+}
+
+func (z *fakeZone) Unbind(br BindingRequest, generations []int) error {
+	return z.call("Unbind %v", br.BindingId)
+}
+
+// A router with a handler for the zones, accepting the credentials u:p.
+func newTestRouter(t *testing.T, zones ...*fakeZone) (*router, *handler) {
+	bs := make([]BrokerService, len(zones))
+	for i, z := range zones {
+		bs[i] = z
+	}
+	a, err := newAuthenticator(Options{Username: "u", Password: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHandler(bs, NewMemoryStore(), nil)
+	return newRouter(Options{}, a, h, nil), h
+}
+
+func serve(r *router, method, path, version, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("X-Broker-Api-Version", version)
+	req.SetBasicAuth("u", "p")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+const (
+	provisioningBody = `{"service_id":"s","plan_id":"p","organization_guid":"o","space_guid":"sp"}`
+	bindingBody      = `{"service_id":"s","plan_id":"p","app_guid":"a"}`
+)
+
+func TestDrainAbortsOperationsAndWaitsForRollback(t *testing.T) {
+	a := &fakeZone{name: "a", gate: make(chan struct{}), entered: make(chan string, 2)}
+	b := &fakeZone{name: "b"}
+	r, h := newTestRouter(t, a, b)
+
+	bound := make(chan int)
+	go func() {
+		bound <- serve(r, "PUT", "/v2/service_instances/i1/service_bindings/b1", "2.7", bindingBody).Code
+	}()
+	<-a.entered
+
+	expired, cancel := context.WithCancel(context.Background())
+	cancel()
+	drained := make(chan error)
+	go func() { drained <- h.drain(expired) }()
+	for {
+		h.mu.Lock()
+		draining := h.draining
+		h.mu.Unlock()
+		if draining {
+			break
+		}
+	}
+
+	if code := serve(r, "PUT", "/v2/service_instances/i2/service_bindings/b2", "2.7", bindingBody).Code; code != http.StatusServiceUnavailable {
+		t.Errorf("Binding while draining: status %v; want %v", code, http.StatusServiceUnavailable)
+	}
+	select {
+	case err := <-drained:
+		t.Fatalf("Drained before the binding finished: %v", err)
+	default:
+	}
+
+	close(a.gate)
+	if err := <-drained; err != context.Canceled {
+		t.Errorf("Drain returned %v; want %v", err, context.Canceled)
+	}
+	if code := <-bound; code != http.StatusInternalServerError {
+		t.Errorf("Aborted binding: status %v; want %v", code, http.StatusInternalServerError)
+	}
+	if want := []string{"Bind b1", "Unbind b1"}; !reflect.DeepEqual(a.called(), want) {
+		t.Errorf("Zone a got %v; want %v", a.called(), want)
+	}
+	if calls := b.called(); len(calls) != 0 {
+		t.Errorf("Zone b got %v; want nothing", calls)
+	}
+}
+
+func lastOperationState(t *testing.T, r *router, iid string) string {
+	w := serve(r, "GET", "/v2/service_instances/"+iid+"/last_operation", "2.7", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Polling [%v]: status %v", iid, w.Code)
+	}
+	var op operation
+	if err := json.NewDecoder(w.Body).Decode(&op); err != nil {
+		t.Fatal(err)
+	}
+	return op.State
+}
+
+func TestAsynchronousProvisioning(t *testing.T) {
+	a := &fakeZone{name: "a", gate: make(chan struct{}), entered: make(chan string, 1)}
+	r, h := newTestRouter(t, a)
+	path := "/v2/service_instances/i1"
+
+	w := serve(r, "PUT", path+"?accepts_incomplete=true", "2.7", provisioningBody)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Provisioning: status %v; want %v", w.Code, http.StatusAccepted)
+	}
+	<-a.entered
+	if state := lastOperationState(t, r, "i1"); state != stateInProgress {
+		t.Errorf("State %q; want %q", state, stateInProgress)
+	}
+
+	// A replay is told about the same operation; anything else must wait
+	if replay := serve(r, "PUT", path+"?accepts_incomplete=true", "2.7", provisioningBody); replay.Code != http.StatusAccepted || replay.Body.String() != w.Body.String() {
+		t.Errorf("Replay: %v %v; want %v %v", replay.Code, replay.Body, http.StatusAccepted, w.Body)
+	}
+	if code := serve(r, "PUT", path, "2.7", provisioningBody).Code; code != http.StatusUnprocessableEntity {
+		t.Errorf("Synchronous provisioning: status %v; want %v", code, http.StatusUnprocessableEntity)
+	}
+	if code := serve(r, "DELETE", path, "2.7", "").Code; code != http.StatusUnprocessableEntity {
+		t.Errorf("Deprovisioning: status %v; want %v", code, http.StatusUnprocessableEntity)
+	}
+
+	close(a.gate)
+	for lastOperationState(t, r, "i1") == stateInProgress {
+		time.Sleep(time.Millisecond)
+	}
+	if state := lastOperationState(t, r, "i1"); state != stateSucceeded {
+		t.Errorf("State %q; want %q", state, stateSucceeded)
+	}
+	if want := []string{"Provision i1"}; !reflect.DeepEqual(a.called(), want) {
+		t.Errorf("Zone a got %v; want %v", a.called(), want)
+	}
+
+	// Operations are not kept across restarts
+	h.operations.forget("i1")
+	if state := lastOperationState(t, r, "i1"); state != stateSucceeded {
+		t.Errorf("State after restart %q; want %q", state, stateSucceeded)
+	}
+	if code := serve(r, "GET", "/v2/service_instances/i2/last_operation", "2.7", "").Code; code != http.StatusGone {
+		t.Errorf("Polling unknown instance: status %v; want %v", code, http.StatusGone)
+	}
+}
+
+func TestFailedAsynchronousProvisioning(t *testing.T) {
+	a := &fakeZone{name: "a"}
+	b := &fakeZone{name: "b", err: errors.New("boom")}
+	r, _ := newTestRouter(t, a, b)
+
+	if code := serve(r, "PUT", "/v2/service_instances/i1?accepts_incomplete=true", "2.7", provisioningBody).Code; code != http.StatusAccepted {
+		t.Fatalf("Provisioning: status %v; want %v", code, http.StatusAccepted)
+	}
+	for lastOperationState(t, r, "i1") == stateInProgress {
+		time.Sleep(time.Millisecond)
+	}
+	if state := lastOperationState(t, r, "i1"); state != stateFailed {
+		t.Errorf("State %q; want %q", state, stateFailed)
+	}
+	if want := []string{"Provision i1", "Deprovision i1"}; !reflect.DeepEqual(a.called(), want) {
+		t.Errorf("Zone a got %v; want %v", a.called(), want)
+	}
+}
+
+func TestProvisioningReplays(t *testing.T) {
+	a := &fakeZone{name: "a"}
+	r, _ := newTestRouter(t, a)
+	path := "/v2/service_instances/i1"
+
+	tests := []struct {
+		version, path, body string
+		status              int
+	}{
+		{"2.6", path, provisioningBody, http.StatusCreated},
+		{"2.6", path, provisioningBody, http.StatusOK},
+		{"2.7", path + "?accepts_incomplete=true", provisioningBody, http.StatusOK},
+		{"2.6", path, strings.Replace(provisioningBody, `"p"`, `"q"`, 1), http.StatusConflict},
+	}
+	for i, test := range tests {
+		if code := serve(r, "PUT", test.path, test.version, test.body).Code; code != test.status {
+			t.Errorf("Request %v: status %v; want %v", i, code, test.status)
+		}
+	}
+	if want := []string{"Provision i1"}; !reflect.DeepEqual(a.called(), want) {
+		t.Errorf("Zone a got %v; want %v", a.called(), want)
+	}
+}
+
+func TestConcurrentIdenticalProvisioning(t *testing.T) {
+	a := &fakeZone{name: "a", gate: make(chan struct{}), entered: make(chan string, 1)}
+	r, h := newTestRouter(t, a)
+	path := "/v2/service_instances/i1"
+
+	codes := make(chan int, 2)
+	go func() { codes <- serve(r, "PUT", path, "2.6", provisioningBody).Code }()
+	<-a.entered
+	go func() { codes <- serve(r, "PUT", path, "2.6", provisioningBody).Code }()
+
+	waitForLock(h, "instance/i1", 2)
+	close(a.gate)
+
+	first, second := <-codes, <-codes
+	if first != http.StatusCreated || second != http.StatusOK {
+		t.Errorf("Statuses %v, %v; want %v, %v", first, second, http.StatusCreated, http.StatusOK)
+	}
+	if want := []string{"Provision i1"}; !reflect.DeepEqual(a.called(), want) {
+		t.Errorf("Zone a got %v; want %v", a.called(), want)
+	}
+}
+
+func TestBindingWaitsForDeprovisioning(t *testing.T) {
+	a := &fakeZone{name: "a"}
+	r, h := newTestRouter(t, a)
+	if code := serve(r, "PUT", "/v2/service_instances/i1", "2.6", provisioningBody).Code; code != http.StatusCreated {
+		t.Fatalf("Provisioning: status %v", code)
+	}
+
+	a.gate, a.entered = make(chan struct{}), make(chan string, 2)
+	deprovisioned := make(chan int)
+	go func() { deprovisioned <- serve(r, "DELETE", "/v2/service_instances/i1", "2.6", "").Code }()
+	<-a.entered
+	bound := make(chan int)
+	go func() {
+		bound <- serve(r, "PUT", "/v2/service_instances/i1/service_bindings/b1", "2.6", bindingBody).Code
+	}()
+	waitForLock(h, "instance/i1", 2)
+	close(a.gate)
+
+	if code := <-deprovisioned; code != http.StatusOK {
+		t.Errorf("Deprovisioning: status %v; want %v", code, http.StatusOK)
+	}
+	<-bound
+	if want := []string{"Provision i1", "Deprovision i1", "Bind b1"}; !reflect.DeepEqual(a.called(), want) {
+		t.Errorf("Zone a got %v; want %v", a.called(), want)
+	}
+}
+
+// Waits until the given number of requests hold or wait for the lock.
+func waitForLock(h *handler, id string, n int) {
+	for {
+		h.locks.mu.Lock()
+		rl := h.locks.byId[id]
+		locked := rl != nil && rl.waiters == n
+		h.locks.mu.Unlock()
+		if locked {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUserGenerations(t *testing.T) {
+	if got, want := userGenerations(0, nil), []int{0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Generations %v; want %v", got, want)
+	}
+	if got, want := userGenerations(2, &Retirement{Generation: 1}), []int{2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Generations %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import "sync"
+
+type recordLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// Serializes the operations on one service instance or binding, covering
+// both the users in the zones and the record in the state store. Operations
+// which touch an instance and one of its bindings lock the instance first.
+type recordLocks struct {
+	mu   sync.Mutex
+	byId map[string]*recordLock
+}
+
+func newRecordLocks() *recordLocks {
+	return &recordLocks{byId: make(map[string]*recordLock)}
+}
+
+func (l *recordLocks) instance(iid string) (unlock func()) {
+	return l.lock("instance/" + iid)
+}
+
+func (l *recordLocks) binding(bid string) (unlock func()) {
+	return l.lock("binding/" + bid)
+}
+
+func (l *recordLocks) lock(id string) func() {
+	l.mu.Lock()
+	rl, ok := l.byId[id]
+	if !ok {
+		rl = &recordLock{}
+		l.byId[id] = rl
+	}
+	rl.waiters++
+	l.mu.Unlock()
+
+	rl.Lock()
+	return func() {
+		rl.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if rl.waiters--; rl.waiters == 0 {
+			delete(l.byId, id)
+		}
+	}
+}
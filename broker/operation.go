@@ -0,0 +1,87 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+)
+
+// States reported by the last_operation endpoint.
+// See http://docs.cloudfoundry.org/services/api.html#polling
+const (
+	stateInProgress = "in progress"
+	stateSucceeded  = "succeeded"
+	stateFailed     = "failed"
+)
+
+type operation struct {
+	Id          string `json:"-"`
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+}
+
+// Tracks the latest asynchronous operation of every service instance.
+type operations struct {
+	mu         sync.Mutex
+	byInstance map[string]*operation
+}
+
+func newOperations() *operations {
+	return &operations{byInstance: make(map[string]*operation)}
+}
+
+// Registers a new in-progress operation for the instance. Returns false if
+// another operation is still in progress for it.
+func (o *operations) start(instanceId, description string) (operation, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if op, ok := o.byInstance[instanceId]; ok && op.State == stateInProgress {
+		return *op, false
+	}
+	op := &operation{newOperationId(), stateInProgress, description}
+	o.byInstance[instanceId] = op
+	return *op, true
+}
+
+func (o *operations) finish(instanceId, description string, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	op, ok := o.byInstance[instanceId]
+	if !ok {
+		return
+	}
+	if err != nil {
+		op.State, op.Description = stateFailed, err.Error()
+	} else {
+		op.State, op.Description = stateSucceeded, description
+	}
+}
+
+func (o *operations) get(instanceId string) (operation, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if op, ok := o.byInstance[instanceId]; ok {
+		return *op, true
+	}
+	return operation{}, false
+}
+
+func (o *operations) forget(instanceId string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	delete(o.byInstance, instanceId)
+}
+
+func newOperationId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -11,14 +11,38 @@ import (
 var Opts Options = Options{}
 
 type Options struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
-	Debug    bool
-	LogFile  string
-	Trace    bool
-	PidFile  string
+	Host            string
+	Port            int
+	Username        string
+	Password        string
+	Credentials     []CredentialOptions
+	Debug           bool
+	LogFile         string
+	Trace           bool
+	PidFile         string
+	StateFile       string
+	ShutdownTimeout int // Seconds to wait for in-flight operations on shutdown
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string // Require client certificates signed by this CA
+
+	// Dashboard single sign-on; enabled when all three URLs are set
+	ExternalUrl        string // Public base URL of the broker
+	UaaUrl             string
+	CloudControllerUrl string
+	SessionTimeout     int // Minutes a dashboard session lasts
+}
+
+// Additional named broker credentials. NotBefore and NotAfter are optional
+// RFC 3339 timestamps bounding when the credentials are accepted. Only
+// credentials marked Admin may use the admin API.
+type CredentialOptions struct {
+	Name      string
+	Username  string
+	Password  string
+	NotBefore string
+	NotAfter  string
+	Admin     bool
 }
 
 func PopulateOptions(opts map[string]interface{}) {
@@ -8,14 +8,86 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/big"
 )
 
 type PasswordGenerator interface {
 	GeneratePassword() (string, error)
 }
 
-var RandomPasswordGenerator = &randomGenerator{16, base64.URLEncoding}
+// Used unless a password policy says otherwise. It is a variable so tests
+// can substitute a generator with predictable passwords.
+var RandomPasswordGenerator PasswordGenerator = &randomGenerator{16, base64.URLEncoding}
+
+// Characters of generated passwords unless a policy names others. None of
+// them needs escaping in AMQP or HTTP URIs.
+const defaultPasswordAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// Minimum bits of entropy of generated passwords unless a policy says
+// otherwise; the same as RandomPasswordGenerator's.
+const defaultPasswordStrength = 128
+
+// Describes the passwords to generate. Strength is the minimum entropy in
+// bits; a Length of zero selects the shortest length achieving it.
+type PasswordPolicy struct {
+	Length   int    `json:"length"`
+	Alphabet string `json:"alphabet"`
+	Strength int    `json:"strength"`
+}
+
+// Returns a generator picking every character of a password uniformly at
+// random from the policy's alphabet. Fails if the policy is too weak.
+func NewPasswordGenerator(p PasswordPolicy) (PasswordGenerator, error) {
+	alphabet := []rune(p.Alphabet)
+	if len(alphabet) == 0 {
+		alphabet = []rune(defaultPasswordAlphabet)
+	}
+	seen := make(map[rune]bool)
+	for _, r := range alphabet {
+		if seen[r] {
+			return nil, fmt.Errorf("Password alphabet repeats [%c]", r)
+		}
+		seen[r] = true
+	}
+	if len(alphabet) < 2 {
+		return nil, errors.New("Password alphabet needs at least two characters")
+	}
+
+	strength := p.Strength
+	if strength <= 0 {
+		strength = defaultPasswordStrength
+	}
+	bitsPerChar := math.Log2(float64(len(alphabet)))
+	length := p.Length
+	if length <= 0 {
+		length = int(math.Ceil(float64(strength) / bitsPerChar))
+	}
+	if bits := float64(length) * bitsPerChar; bits < float64(strength) {
+		return nil, fmt.Errorf("Passwords of %v characters have %.0f bits of entropy, less than the required %v", length, bits, strength)
+	}
+	return &alphabetGenerator{alphabet, length}, nil
+}
+
+type alphabetGenerator struct {
+	alphabet []rune
+	length   int
+}
+
+func (g *alphabetGenerator) GeneratePassword() (string, error) {
+	max := big.NewInt(int64(len(g.alphabet)))
+	password := make([]rune, g.length)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("Failed to generate password: %v", err)
+		}
+		password[i] = g.alphabet[n.Int64()]
+	}
+	return string(password), nil
+}
 
 type randomGenerator struct {
 	strength int
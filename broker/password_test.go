@@ -0,0 +1,60 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewPasswordGenerator(t *testing.T) {
+	tests := []struct {
+		policy PasswordPolicy
+		length int
+	}{
+		{PasswordPolicy{}, 22},                // 62 characters, 128 bits
+		{PasswordPolicy{Strength: 64}, 11},    // 62 characters, 64 bits
+		{PasswordPolicy{Alphabet: "01"}, 128}, // 1 bit per character
+		{PasswordPolicy{Alphabet: "0123456789abcdef", Length: 40}, 40},
+		{PasswordPolicy{Alphabet: "äöüß", Strength: 8}, 4}, // Runes, not bytes
+	}
+	for _, test := range tests {
+		g, err := NewPasswordGenerator(test.policy)
+		if err != nil {
+			t.Errorf("%+v: %v", test.policy, err)
+			continue
+		}
+		alphabet := test.policy.Alphabet
+		if alphabet == "" {
+			alphabet = defaultPasswordAlphabet
+		}
+		password, err := g.GeneratePassword()
+		if err != nil {
+			t.Errorf("%+v: %v", test.policy, err)
+			continue
+		}
+		if n := len([]rune(password)); n != test.length {
+			t.Errorf("%+v: password of %v characters; want %v", test.policy, n, test.length)
+		}
+		for _, r := range password {
+			if !strings.ContainsRune(alphabet, r) {
+				t.Errorf("%+v: password contains [%c], which is not in the alphabet", test.policy, r)
+			}
+		}
+	}
+}
+
+func TestNewPasswordGeneratorRejectsWeakPolicies(t *testing.T) {
+	for _, p := range []PasswordPolicy{
+		{Alphabet: "a"},    // Too few characters
+		{Alphabet: "abca"}, // Repeated character
+		{Length: 21},       // 125 bits
+		{Alphabet: "0123456789", Length: 8, Strength: 32},
+	} {
+		if _, err := NewPasswordGenerator(p); err == nil {
+			t.Errorf("%+v: NewPasswordGenerator succeeded", p)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"encoding/base64"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// Management API endpoints without a vhost which tenants may read. They
+// only cover the management user's own vhost as long as the user has no
+// 'monitoring' or 'administrator' tag, which plans do not grant.
+var globalResources = map[string]bool{
+	"overview":     true,
+	"whoami":       true,
+	"extensions":   true,
+	"cluster-name": true,
+	"vhosts":       true,
+}
+
+// Resources addressed as /api/<resource>/<vhost>/...; listing them across
+// all vhosts is narrowed down to the instance's vhost.
+var vhostResources = map[string]bool{
+	"exchanges": true,
+	"queues":    true,
+	"bindings":  true,
+	"consumers": true,
+	"policies":  true,
+}
+
+// Prefixes of the policies the broker sets on an instance's vhost, named
+// <prefix><vhost>: the plan's queue policy and the federation policies.
+// Tenants may read them but not replace or delete them.
+var brokerPolicyPrefixes = []string{"q-", "p-", "fq-"}
+
+// Resources listed per vhost as /api/vhosts/<vhost>/<resource>.
+var vhostChildResources = map[string]bool{
+	"connections": true,
+	"channels":    true,
+}
+
+// Forwards the request to the management UI/API of the instance's primary
+// zone, authenticated with the instance's management user.
+func (d *dashboard) proxy(w http.ResponseWriter, req *http.Request) {
+	iid := mux.Vars(req)[instanceId]
+	prefix := dashboardPrefix + url.PathEscape(iid)
+	if !d.hasSession(req, iid) {
+		http.Redirect(w, req, prefix, http.StatusFound)
+		return
+	}
+
+	instance, err := d.store.GetInstance(iid)
+	if err != nil {
+		dashboardLog.Errorf("Cannot look up service instance [%v]: %v", iid, err)
+		http.Error(w, "Cannot look up service instance", http.StatusInternalServerError)
+		return
+	}
+	if instance == nil || instance.Management == nil {
+		http.Error(w, "Service instance has no dashboard", http.StatusNotFound)
+		return
+	}
+
+	path, ok := restrictToVhost(req.Method, strings.TrimPrefix(req.URL.EscapedPath(), prefix), iid)
+	if !ok {
+		dashboardLog.Printf("Management API request refused for [%v]: %v %v", iid, req.Method, path)
+		http.Error(w, "Request not allowed for this service instance", http.StatusForbidden)
+		return
+	}
+	mgmt := instance.Management
+	target, err := url.Parse(strings.TrimRight(mgmt.Url, "/") + path)
+	if err != nil {
+		http.Error(w, "Invalid request path", http.StatusBadRequest)
+		return
+	}
+
+	// The management UI shows its login form unless it finds credentials in
+	// its 'auth' cookie. Whatever it sends is replaced below, so a
+	// placeholder keeps the real password out of the browser.
+	if path == "/" || path == "/index.html" {
+		http.SetCookie(w, &http.Cookie{
+			Name:  "auth",
+			Value: url.QueryEscape(base64.StdEncoding.EncodeToString([]byte("dashboard:dashboard"))),
+			Path:  prefix + "/",
+		})
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme, out.URL.Host = target.Scheme, target.Host
+			out.URL.Path, out.URL.RawPath = target.Path, target.RawPath
+			out.Host = target.Host
+			out.Header.Del("Cookie")
+			out.SetBasicAuth(mgmt.Username, mgmt.Password)
+		},
+		Transport: d.services[0].ManagementTransport(),
+		ModifyResponse: func(resp *http.Response) error {
+			// Keep the browser from prompting for management credentials
+			resp.Header.Del("WWW-Authenticate")
+			resp.Header.Del("Set-Cookie")
+			return nil
+		},
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+// Checks a proxied request path against the instance's vhost. Returns the
+// path to forward, which may be narrowed down to the vhost, and whether the
+// request is allowed. Anything outside /api/ is part of the UI.
+func restrictToVhost(method, path, vhost string) (string, bool) {
+	if !strings.HasPrefix(path, "/api/") {
+		return path, true
+	}
+	read := method == "GET" || method == "HEAD"
+	isVhost := func(segment string) bool {
+		v, err := url.PathUnescape(segment)
+		return err == nil && v == vhost
+	}
+
+	segments := strings.Split(strings.TrimPrefix(path, "/api/"), "/")
+	resource := segments[0]
+	switch {
+	case len(segments) == 1 && globalResources[resource]:
+		return path, read
+	case len(segments) == 1 && vhostResources[resource]:
+		return "/api/" + resource + "/" + url.PathEscape(vhost), read
+	case len(segments) == 1 && vhostChildResources[resource]:
+		return "/api/vhosts/" + url.PathEscape(vhost) + "/" + resource, read
+	case len(segments) == 1:
+		return path, false
+	case resource == "policies" && len(segments) > 2 && !read:
+		return path, isVhost(segments[1]) && !isBrokerPolicy(segments[2], vhost)
+	case vhostResources[resource] || resource == "definitions" || resource == "aliveness-test":
+		return path, isVhost(segments[1])
+	case resource == "vhosts":
+		return path, read && isVhost(segments[1])
+	case resource == "parameters" && len(segments) > 2:
+		return path, isVhost(segments[2])
+	}
+	return path, false
+}
+
+// Reports whether the escaped policy name is one the broker owns.
+func isBrokerPolicy(segment, vhost string) bool {
+	name, err := url.PathUnescape(segment)
+	if err != nil {
+		return true
+	}
+	for _, prefix := range brokerPolicyPrefixes {
+		if name == prefix+vhost {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import "testing"
+
+func TestRestrictToVhost(t *testing.T) {
+	const vhost = "c0ffee"
+	tests := []struct {
+		method, path string
+		want         string
+		allowed      bool
+	}{
+		// UI and global resources
+		{"GET", "/", "/", true},
+		{"GET", "/js/main.js", "/js/main.js", true},
+		{"GET", "/api/overview", "/api/overview", true},
+		{"GET", "/api/vhosts", "/api/vhosts", true},
+		{"PUT", "/api/overview", "/api/overview", false},
+		{"GET", "/api/users", "/api/users", false},
+		{"GET", "/api/nodes", "/api/nodes", false},
+
+		// Listings narrowed down to the instance's vhost
+		{"GET", "/api/queues", "/api/queues/c0ffee", true},
+		{"GET", "/api/connections", "/api/vhosts/c0ffee/connections", true},
+		{"DELETE", "/api/queues", "/api/queues/c0ffee", false},
+
+		// Single segments without a vhost
+		{"GET", "/api/definitions", "/api/definitions", false},
+		{"POST", "/api/definitions", "/api/definitions", false},
+		{"GET", "/api/aliveness-test", "/api/aliveness-test", false},
+		{"GET", "/api/parameters", "/api/parameters", false},
+		{"GET", "/api/", "/api/", false},
+
+		// Trailing slashes
+		{"GET", "/api/queues/", "/api/queues/", false},
+		{"GET", "/api/definitions/", "/api/definitions/", false},
+		{"GET", "/api/vhosts/", "/api/vhosts/", false},
+		{"GET", "/api/queues/c0ffee/", "/api/queues/c0ffee/", true},
+
+		// The instance's vhost
+		{"GET", "/api/queues/c0ffee/q1", "/api/queues/c0ffee/q1", true},
+		{"DELETE", "/api/queues/c0ffee/q1", "/api/queues/c0ffee/q1", true},
+		{"GET", "/api/definitions/c0ffee", "/api/definitions/c0ffee", true},
+		{"GET", "/api/aliveness-test/c0ffee", "/api/aliveness-test/c0ffee", true},
+		{"GET", "/api/vhosts/c0ffee", "/api/vhosts/c0ffee", true},
+		{"DELETE", "/api/vhosts/c0ffee", "/api/vhosts/c0ffee", false},
+		{"PUT", "/api/policies/c0ffee/mine", "/api/policies/c0ffee/mine", true},
+		{"GET", "/api/policies/c0ffee/q-c0ffee", "/api/policies/c0ffee/q-c0ffee", true},
+		{"PUT", "/api/parameters/federation-upstream/c0ffee/up", "/api/parameters/federation-upstream/c0ffee/up", true},
+
+		// Policies set by the broker
+		{"PUT", "/api/policies/c0ffee/q-c0ffee", "/api/policies/c0ffee/q-c0ffee", false},
+		{"DELETE", "/api/policies/c0ffee/p-c0ffee", "/api/policies/c0ffee/p-c0ffee", false},
+		{"PUT", "/api/policies/c0ffee/fq-c0ffee", "/api/policies/c0ffee/fq-c0ffee", false},
+		{"PUT", "/api/policies/c0ffee/fq-%630ffee", "/api/policies/c0ffee/fq-%630ffee", false},
+
+		// Foreign vhosts
+		{"GET", "/api/queues/other/q1", "/api/queues/other/q1", false},
+		{"GET", "/api/queues/%2F", "/api/queues/%2F", false},
+		{"GET", "/api/definitions/other", "/api/definitions/other", false},
+		{"PUT", "/api/policies/other/mine", "/api/policies/other/mine", false},
+		{"GET", "/api/vhosts/other/connections", "/api/vhosts/other/connections", false},
+		{"PUT", "/api/parameters/federation-upstream/other/up", "/api/parameters/federation-upstream/other/up", false},
+		{"GET", "/api/queues/c0ffee%2F", "/api/queues/c0ffee%2F", false},
+	}
+	for _, test := range tests {
+		got, allowed := restrictToVhost(test.method, test.path, vhost)
+		if got != test.want || allowed != test.allowed {
+			t.Errorf("restrictToVhost(%q, %q) = %q, %v; want %q, %v", test.method, test.path, got, allowed, test.want, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Pause before a failed retirement is retried.
+const retirementRetryDelay = time.Minute
+
+type rotationRequest struct {
+	GracePeriod int `json:"grace_period"` // Seconds the previous credentials stay valid
+}
+
+type rotationEntity struct {
+	Generation         int         `json:"generation"`
+	RotatedAt          time.Time   `json:"rotated_at"`
+	PreviousValidUntil *time.Time  `json:"previous_valid_until,omitempty"`
+	Credentials        Credentials `json:"credentials,omitempty"`
+}
+
+func decodeGracePeriod(req *http.Request) (time.Duration, error) {
+	var rreq rotationRequest
+	if err := json.NewDecoder(req.Body).Decode(&rreq); err != nil && err != io.EOF {
+		return 0, err
+	}
+	if rreq.GracePeriod < 0 {
+		return 0, errors.New("'grace_period' must not be negative")
+	}
+	return time.Duration(rreq.GracePeriod) * time.Second, nil
+}
+
+// Issues new management credentials for a service instance in every zone.
+// The proxied dashboard switches to them at once; the previous management
+// user is retired when the grace period is over.
+func (h *handler) rotateInstance(req *http.Request) responseEntity {
+	iid := mux.Vars(req)[instanceId]
+	grace, err := decodeGracePeriod(req)
+	if err != nil {
+		return handleDecodingError(err)
+	}
+
+	handlerLog.Printf("Rotating management credentials: [%v]", iid)
+
+	end, ok := h.begin()
+	if !ok {
+		return h.shuttingDown()
+	}
+	defer end()
+
+	unlock := h.locks.instance(iid)
+	defer unlock()
+
+	instance, err := h.store.GetInstance(iid)
+	if err != nil {
+		return handleServiceError(err)
+	} else if instance == nil {
+		msg := fmt.Sprintf("Unknown service instance: [%v]", iid)
+		return responseEntity{http.StatusNotFound, BrokerError{msg}}
+	} else if instance.Retiring != nil {
+		msg := fmt.Sprintf("Previous credentials of service instance [%v] are valid until %v", iid, instance.Retiring.At)
+		return responseEntity{http.StatusConflict, BrokerError{msg}}
+	}
+
+	preq := ProvisioningRequest{iid, instance.ServiceId, instance.PlanId, instance.OrgId, instance.SpaceId}
+	generation := instance.Generation + 1
+	var mgmt *Management
+
+	retire := func(bs BrokerService) error { return bs.RetireManagement(preq, generation) }
+	err = inAllZones(h.ctx, "Rotating", h.brokerServices, func(bs BrokerService) error {
+		m, err := bs.RotateManagement(preq, generation)
+		if bs == h.brokerServices[0] {
+			mgmt = m
+		}
+		return err
+	}, retire)
+	if err != nil {
+		return handleServiceError(err)
+	}
+
+	now := time.Now().UTC()
+	retirement := Retirement{instance.Generation, now.Add(grace)}
+	instance.Generation, instance.Management = generation, mgmt
+	instance.RotatedAt, instance.Retiring = &now, &retirement
+	if err := h.store.PutInstance(*instance); err != nil {
+		handlerLog.Errorf("Cannot record rotation: %v", err)
+		e := &zoneError{op: "Rotating", failures: []zoneFailure{{"broker", err}}}
+		e.compensate(h.brokerServices, retire)
+		return handleServiceError(e)
+	}
+
+	handlerLog.Printf("Management credentials rotated: [%v]", iid)
+	h.scheduleInstanceRetirement(iid, retirement)
+
+	return responseEntity{http.StatusOK, newRotationEntity(generation, now, grace, nil)}
+}
+
+// Issues new credentials for a binding in every zone. The previous binding
+// user is retired when the grace period is over.
+func (h *handler) rotateBinding(req *http.Request) responseEntity {
+	vars := mux.Vars(req)
+	iid, bid := vars[instanceId], vars[bindingId]
+	grace, err := decodeGracePeriod(req)
+	if err != nil {
+		return handleDecodingError(err)
+	}
+
+	handlerLog.Printf("Rotating binding credentials: [%v]", bid)
+
+	end, ok := h.begin()
+	if !ok {
+		return h.shuttingDown()
+	}
+	defer end()
+
+	// The instance is locked too, so it cannot be deprovisioned meanwhile
+	unlockInstance := h.locks.instance(iid)
+	defer unlockInstance()
+	unlock := h.locks.binding(bid)
+	defer unlock()
+
+	binding, err := h.store.GetBinding(bid)
+	if err != nil {
+		return handleServiceError(err)
+	} else if binding == nil || binding.InstanceId != iid {
+		msg := fmt.Sprintf("Unknown binding: [%v]", bid)
+		return responseEntity{http.StatusNotFound, BrokerError{msg}}
+	} else if binding.Retiring != nil {
+		msg := fmt.Sprintf("Previous credentials of binding [%v] are valid until %v", bid, binding.Retiring.At)
+		return responseEntity{http.StatusConflict, BrokerError{msg}}
+	}
+
+	breq := BindingRequest{iid, bid, binding.ServiceId, binding.PlanId, binding.AppId}
+	generation := binding.Generation + 1
+	zoneCreds := make(map[string]Credentials)
+
+	retire := func(bs BrokerService) error { return bs.RetireBinding(breq, generation) }
+	err = inAllZones(h.ctx, "Rotating", h.brokerServices, func(bs BrokerService) error {
+		cred, err := bs.RotateBinding(breq, generation)
+		if err != nil {
+			return err
+		}
+		zoneCreds[bs.Zone()] = cred
+		return nil
+	}, retire)
+	if err != nil {
+		return handleServiceError(err)
+	}
+
+	now := time.Now().UTC()
+	retirement := Retirement{binding.Generation, now.Add(grace)}
+	binding.Generation, binding.Credentials = generation, zoneCreds
+	binding.RotatedAt, binding.Retiring = &now, &retirement
+	if err := h.store.PutBinding(*binding); err != nil {
+		handlerLog.Errorf("Cannot record rotation: %v", err)
+		e := &zoneError{op: "Rotating", failures: []zoneFailure{{"broker", err}}}
+		e.compensate(h.brokerServices, retire)
+		return handleServiceError(e)
+	}
+
+	handlerLog.Printf("Binding credentials rotated: [%v]", bid)
+	h.scheduleBindingRetirement(bid, retirement)
+
+	return responseEntity{http.StatusOK, newRotationEntity(generation, now, grace, h.bindingCredentials(zoneCreds))}
+}
+
+func newRotationEntity(generation int, rotatedAt time.Time, grace time.Duration, creds Credentials) rotationEntity {
+	e := rotationEntity{Generation: generation, RotatedAt: rotatedAt, Credentials: creds}
+	if grace > 0 {
+		until := rotatedAt.Add(grace)
+		e.PreviousValidUntil = &until
+	}
+	return e
+}
+
+// Schedules the retirements recorded in the state store, so they survive
+// a restart of the broker.
+func (h *handler) resumeRetirements() error {
+	instances, err := h.store.Instances()
+	if err != nil {
+		return err
+	}
+	for _, i := range instances {
+		if i.Retiring != nil {
+			h.scheduleInstanceRetirement(i.Id, *i.Retiring)
+		}
+		bindings, err := h.store.Bindings(i.Id)
+		if err != nil {
+			return err
+		}
+		for _, b := range bindings {
+			if b.Retiring != nil {
+				h.scheduleBindingRetirement(b.Id, *b.Retiring)
+			}
+		}
+	}
+	return nil
+}
+
+func (h *handler) scheduleInstanceRetirement(iid string, r Retirement) {
+	h.scheduleRetirement(fmt.Sprintf("management credentials of [%v]", iid), r.At, func() error {
+		unlock := h.locks.instance(iid)
+		defer unlock()
+
+		instance, err := h.store.GetInstance(iid)
+		if err != nil || instance == nil || instance.Retiring == nil {
+			return err // Nothing left to retire
+		}
+		preq := ProvisioningRequest{iid, instance.ServiceId, instance.PlanId, instance.OrgId, instance.SpaceId}
+		err = inEachZone("Retiring", h.brokerServices, func(bs BrokerService) error {
+			return bs.RetireManagement(preq, r.Generation)
+		})
+		if err := ignoreGone(err); err != nil {
+			return err
+		}
+		instance.Retiring = nil
+		return h.store.PutInstance(*instance)
+	})
+}
+
+func (h *handler) scheduleBindingRetirement(bid string, r Retirement) {
+	h.scheduleRetirement(fmt.Sprintf("credentials of binding [%v]", bid), r.At, func() error {
+		unlock := h.locks.binding(bid)
+		defer unlock()
+
+		binding, err := h.store.GetBinding(bid)
+		if err != nil || binding == nil || binding.Retiring == nil {
+			return err // Nothing left to retire
+		}
+		breq := BindingRequest{binding.InstanceId, bid, binding.ServiceId, binding.PlanId, binding.AppId}
+		err = inEachZone("Retiring", h.brokerServices, func(bs BrokerService) error {
+			return bs.RetireBinding(breq, r.Generation)
+		})
+		if err := ignoreGone(err); err != nil {
+			return err
+		}
+		binding.Retiring = nil
+		return h.store.PutBinding(*binding)
+	})
+}
+
+// Runs retire at the given time, retrying until it succeeds. Retirements
+// due while the broker shuts down are resumed after the restart.
+func (h *handler) scheduleRetirement(what string, at time.Time, retire func() error) {
+	time.AfterFunc(time.Until(at), func() {
+		end, ok := h.begin()
+		if !ok {
+			return
+		}
+		defer end()
+
+		if err := retire(); err != nil {
+			handlerLog.Errorf("Retiring previous %v failed; retrying in %v: %v", what, retirementRetryDelay, err)
+			h.scheduleRetirement(what, time.Now().Add(retirementRetryDelay), retire)
+			return
+		}
+		handlerLog.Printf("Retired previous %v", what)
+	})
+}
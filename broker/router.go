@@ -5,12 +5,13 @@
 package broker
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
-	"log"
+	"math"
 	"net/http"
 	"net/http/httputil"
 	"strconv"
@@ -23,50 +24,138 @@ const (
 	bindingId  = "bid"
 )
 
+var routerLog = NewLogger("Router")
+
+var (
+	catalogUrlPattern       = fmt.Sprintf("/%v/catalog", apiVersion)
+	provisioningUrlPattern  = fmt.Sprintf("/%v/service_instances/{%v}", apiVersion, instanceId)
+	lastOperationUrlPattern = fmt.Sprintf("/%v/service_instances/{%v}/last_operation", apiVersion, instanceId)
+	bindingUrlPattern       = fmt.Sprintf("/%v/service_instances/{%v}/service_bindings/{%v}", apiVersion, instanceId, bindingId)
+)
+
+// Admin API, available to admin credentials only.
+const adminPrefix = "/admin/"
+
 var (
-	catalogUrlPattern      = fmt.Sprintf("/%v/catalog", apiVersion)
-	provisioningUrlPattern = fmt.Sprintf("/%v/service_instances/{%v}", apiVersion, instanceId)
-	bindingUrlPattern      = fmt.Sprintf("/%v/service_instances/{%v}/service_bindings/{%v}", apiVersion, instanceId, bindingId)
+	rotateInstanceUrlPattern = fmt.Sprintf("%vservice_instances/{%v}/rotate", adminPrefix, instanceId)
+	rotateBindingUrlPattern  = fmt.Sprintf("%vservice_instances/{%v}/service_bindings/{%v}/rotate", adminPrefix, instanceId, bindingId)
 )
 
+// Range of Service Broker API versions supported by this broker. Minor
+// versions are backwards compatible, so any 2.x caller is accepted and
+// handlers opt into newer behaviour via brokerApiVersion.atLeast.
+var (
+	minApiVersion = brokerApiVersion{2, 0}
+	maxApiVersion = brokerApiVersion{2, math.MaxInt32}
+)
+
+type brokerApiVersion struct {
+	major int
+	minor int
+}
+
+func (v brokerApiVersion) atLeast(major, minor int) bool {
+	return v.major > major || (v.major == major && v.minor >= minor)
+}
+
+func (v brokerApiVersion) String() string {
+	if v.minor == math.MaxInt32 {
+		return fmt.Sprintf("%v.x", v.major)
+	}
+	return fmt.Sprintf("%v.%v", v.major, v.minor)
+}
+
+func (v brokerApiVersion) supported() bool {
+	return v.atLeast(minApiVersion.major, minApiVersion.minor) &&
+		maxApiVersion.atLeast(v.major, v.minor)
+}
+
+type contextKey int
+
+const apiVersionKey contextKey = iota
+
+// Returns the Service Broker API version negotiated for the request.
+func requestApiVersion(req *http.Request) brokerApiVersion {
+	if v, ok := req.Context().Value(apiVersionKey).(brokerApiVersion); ok {
+		return v
+	}
+	return minApiVersion
+}
+
 type router struct {
 	opts Options
+	auth *authenticator
 	mux  *mux.Router // TODO: Replace with own simpler regexp-based mux???
 }
 
-func newRouter(o Options, h *handler) *router {
+func newRouter(o Options, a *authenticator, h *handler, d *dashboard) *router {
 	mux := mux.NewRouter()
 	mux.Handle(catalogUrlPattern, reponseHandler(h.catalog)).Methods("GET")
 	mux.Handle(provisioningUrlPattern, reponseHandler(h.provision)).Methods("PUT")
 	mux.Handle(provisioningUrlPattern, reponseHandler(h.deprovision)).Methods("DELETE")
+	mux.Handle(lastOperationUrlPattern, reponseHandler(h.lastOperation)).Methods("GET")
 	mux.Handle(bindingUrlPattern, reponseHandler(h.bind)).Methods("PUT")
 	mux.Handle(bindingUrlPattern, reponseHandler(h.unbind)).Methods("DELETE")
-	return &router{o, mux}
+	mux.Handle(rotateInstanceUrlPattern, reponseHandler(h.rotateInstance)).Methods("POST")
+	mux.Handle(rotateBindingUrlPattern, reponseHandler(h.rotateBinding)).Methods("POST")
+	if d != nil {
+		mux.HandleFunc(dashboardCallbackUrlPattern, d.callback).Methods("GET")
+		mux.HandleFunc(dashboardUrlPattern, d.show).Methods("GET")
+		mux.PathPrefix(dashboardUrlPattern + "/").HandlerFunc(d.proxy)
+	}
+	return &router{o, a, mux}
 }
 
 // Log & verify request and then pass it to Gorilla to be dispatched approprietly.
 func (r *router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if dump, err := httputil.DumpRequest(req, true); err != nil {
-		log.Printf("Cannot log incoming request: %v", err)
-	} else {
-		log.Print(string(dump))
+	if r.opts.Trace {
+		if dump, err := httputil.DumpRequest(req, true); err != nil {
+			routerLog.Errorf("Cannot log incoming request: %v", err)
+		} else {
+			routerLog.Printf("%s", dump)
+		}
 	}
 
-	major, minor, err := extractVersion(req)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	// Dashboard users are authenticated by single sign-on instead
+	if strings.HasPrefix(req.URL.Path, dashboardPrefix) {
+		r.mux.ServeHTTP(w, req)
 		return
 	}
-	log.Printf("Router: Version check: [%v.%v]", major, minor)
-	//TODO: Verify compatibility
+
+	// The admin API is not part of the Service Broker API
+	admin := strings.HasPrefix(req.URL.Path, adminPrefix)
+	if !admin {
+		version, err := extractVersion(req)
+		if err == nil && !version.supported() {
+			err = fmt.Errorf("Broker API version %v is not supported", version)
+		}
+		if err != nil {
+			msg := fmt.Sprintf("%v; supported versions are %v to %v", err, minApiVersion, maxApiVersion)
+			routerLog.Printf("%v", msg)
+			writeEntity(w, responseEntity{http.StatusPreconditionFailed, BrokerError{msg}})
+			return
+		}
+		routerLog.Debugf("Version check: [%v]", version)
+		req = req.WithContext(context.WithValue(req.Context(), apiVersionKey, version))
+	}
 
 	username, password, err := extractCredentials(req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusUnauthorized)
+		unauthorized(w, err.Error())
+		return
+	}
+	creds, ok := r.auth.authenticate(username, password)
+	if !ok {
+		routerLog.Errorf("Authentication failed: [%v]", username)
+		unauthorized(w, "Invalid credentials")
+		return
+	}
+	routerLog.Debugf("Authenticated: [%v] using credentials [%v]", username, creds.name)
+	if admin && !creds.admin {
+		routerLog.Errorf("Admin API access refused: [%v] using credentials [%v]", username, creds.name)
+		writeEntity(w, responseEntity{http.StatusForbidden, BrokerError{"Admin credentials required"}})
 		return
 	}
-	log.Printf("Router: Authentication: [%v/%v]", username, password)
-	//TODO: Authenticate based on the opts object
 
 	r.mux.ServeHTTP(w, req)
 }
@@ -80,30 +169,38 @@ type reponseHandler func(*http.Request) responseEntity
 
 // Marshall the response entity as JSON and return the proper HTTP status code.
 func (fn reponseHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	re := fn(req)
+	writeEntity(w, fn(req))
+}
+
+func writeEntity(w http.ResponseWriter, re responseEntity) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(re.status)
 	if err := json.NewEncoder(w).Encode(re.value); err != nil {
-		log.Printf("Error occured while marshalling response entity: %v", err)
+		routerLog.Errorf("Error occured while marshalling response entity: %v", err)
 	}
 }
 
 // Helpers
-func extractVersion(req *http.Request) (int, int, error) {
+func unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", authRealm))
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+func extractVersion(req *http.Request) (brokerApiVersion, error) {
 	versions, _ := req.Header["X-Broker-Api-Version"]
 	if len(versions) != 1 {
-		return 0, 0, errors.New("Missing Broker API version")
+		return brokerApiVersion{}, errors.New("Missing Broker API version")
 	}
 	tokens := strings.Split(versions[0], ".")
 	if len(tokens) != 2 {
-		return 0, 0, errors.New("Invalid Broker API version")
+		return brokerApiVersion{}, errors.New("Invalid Broker API version")
 	}
 	major, err1 := strconv.Atoi(tokens[0])
 	minor, err2 := strconv.Atoi(tokens[1])
 	if err1 != nil || err2 != nil {
-		return 0, 0, errors.New("Invalid Broker API version")
+		return brokerApiVersion{}, errors.New("Invalid Broker API version")
 	}
-	return major, minor, nil
+	return brokerApiVersion{major, minor}, nil
 }
 
 func extractCredentials(req *http.Request) (string, string, error) {
@@ -119,7 +216,7 @@ func extractCredentials(req *http.Request) (string, string, error) {
 	if err != nil {
 		return "", "", errors.New("Unable to decode 'Authorization' header")
 	}
-	credentials := strings.Split(string(raw), ":")
+	credentials := strings.SplitN(string(raw), ":", 2)
 	if len(credentials) != 2 {
 		return "", "", errors.New("Missing credentials")
 	}
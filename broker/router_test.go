@@ -0,0 +1,32 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUnsupportedApiVersions(t *testing.T) {
+	a, err := newAuthenticator(Options{Username: "u", Password: "p"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := newRouter(Options{}, a, newHandler(nil, NewMemoryStore(), nil), nil)
+
+	for _, version := range []string{"", "2", "two.six", "2.6.1", "1.9", "3.0"} {
+		req := httptest.NewRequest("GET", catalogUrlPattern, nil)
+		if version != "" {
+			req.Header.Set("X-Broker-Api-Version", version)
+		}
+		req.SetBasicAuth("u", "p")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("Version %q: status %v; want %v", version, w.Code, http.StatusPreconditionFailed)
+		}
+	}
+}
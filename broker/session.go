@@ -0,0 +1,75 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+type session struct {
+	instanceId string
+	expires    time.Time
+}
+
+// Dashboard sessions and pending OAuth2 authorizations by random ID. They
+// are kept in memory only; after a restart users simply sign on again.
+type sessions struct {
+	mu   sync.Mutex
+	byId map[string]session
+}
+
+func newSessions() *sessions {
+	return &sessions{byId: make(map[string]session)}
+}
+
+// Registers a session for the instance which lasts ttl. Returns its ID.
+func (s *sessions) create(instanceId string, ttl time.Duration) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, e := range s.byId {
+		if now.After(e.expires) {
+			delete(s.byId, id)
+		}
+	}
+	id := newSessionId()
+	s.byId[id] = session{instanceId, now.Add(ttl)}
+	return id
+}
+
+// Returns the instance of a session which has not expired yet.
+func (s *sessions) get(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.byId[id]
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.instanceId, true
+}
+
+// Like get, but the session can be used only once.
+func (s *sessions) take(id string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.byId[id]
+	delete(s.byId, id)
+	if !ok || time.Now().After(e.expires) {
+		return "", false
+	}
+	return e.instanceId, true
+}
+
+func newSessionId() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
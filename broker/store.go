@@ -0,0 +1,247 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+// The StateStore records the service instances and bindings created by the
+// broker, so it does not have to infer them from naming conventions on the
+// RabbitMQ clusters.
+type StateStore interface {
+
+	// Returns the recorded service instance or nil if there is none.
+	GetInstance(id string) (*Instance, error)
+
+	// Returns all recorded service instances.
+	Instances() ([]Instance, error)
+
+	// Records a service instance, replacing any previous record.
+	PutInstance(Instance) error
+
+	// Removes a service instance record together with its bindings.
+	DeleteInstance(id string) error
+
+	// Returns the recorded binding or nil if there is none.
+	GetBinding(id string) (*Binding, error)
+
+	// Returns all recorded bindings of a service instance.
+	Bindings(instanceId string) ([]Binding, error)
+
+	// Records a binding, replacing any previous record.
+	PutBinding(Binding) error
+
+	// Removes a binding record.
+	DeleteBinding(id string) error
+}
+
+type Instance struct {
+	Id         string      `json:"id"`
+	ServiceId  string      `json:"service_id"`
+	PlanId     string      `json:"plan_id"`
+	OrgId      string      `json:"organization_guid"`
+	SpaceId    string      `json:"space_guid"`
+	Zones      []string    `json:"zones"`
+	Management *Management `json:"management,omitempty"` // Never handed out; see dashboard
+	CreatedAt  time.Time   `json:"created_at"`
+	Generation int         `json:"generation,omitempty"` // Of the management credentials
+	RotatedAt  *time.Time  `json:"rotated_at,omitempty"`
+	Retiring   *Retirement `json:"retiring,omitempty"`
+}
+
+// Reports whether a replayed provisioning request is identical to the one
+// that created the instance.
+func (i *Instance) matches(preq ProvisioningRequest) bool {
+	return i.ServiceId == preq.ServiceId && i.PlanId == preq.PlanId &&
+		i.OrgId == preq.OrgId && i.SpaceId == preq.SpaceId
+}
+
+// Bindings keep the credentials they were issued, so a replayed binding
+// request can be answered with the original response.
+type Binding struct {
+	Id             string                 `json:"id"`
+	InstanceId     string                 `json:"instance_id"`
+	ServiceId      string                 `json:"service_id"`
+	PlanId         string                 `json:"plan_id"`
+	AppId          string                 `json:"app_guid"`
+	Zones          []string               `json:"zones"`
+	Credentials    map[string]Credentials `json:"credentials"`
+	SyslogDrainUrl string                 `json:"syslog_drain_url"`
+	CreatedAt      time.Time              `json:"created_at"`
+	Generation     int                    `json:"generation,omitempty"`
+	RotatedAt      *time.Time             `json:"rotated_at,omitempty"`
+	Retiring       *Retirement            `json:"retiring,omitempty"`
+}
+
+// Credentials replaced by a rotation which stay valid until At.
+type Retirement struct {
+	Generation int       `json:"generation"`
+	At         time.Time `json:"at"`
+}
+
+// Generations of credentials which exist for a record: the current one and
+// the one still retiring, if any. Without a record only the first exists.
+func userGenerations(generation int, retiring *Retirement) []int {
+	generations := []int{generation}
+	if retiring != nil {
+		generations = append(generations, retiring.Generation)
+	}
+	return generations
+}
+
+// Reports whether a replayed binding request is identical to the one that
+// created the binding.
+func (b *Binding) matches(breq BindingRequest) bool {
+	return b.InstanceId == breq.InstanceId && b.ServiceId == breq.ServiceId &&
+		b.PlanId == breq.PlanId && b.AppId == breq.AppId
+}
+
+type storeState struct {
+	Instances map[string]Instance `json:"instances"`
+	Bindings  map[string]Binding  `json:"bindings"`
+}
+
+func newStoreState() storeState {
+	return storeState{make(map[string]Instance), make(map[string]Binding)}
+}
+
+// In-memory StateStore. When persist is set it is called with the new state
+// after every change; if it fails the change is reverted.
+type memoryStore struct {
+	mu      sync.RWMutex
+	state   storeState
+	persist func(storeState) error
+}
+
+// Returns a StateStore which forgets everything when the broker stops.
+func NewMemoryStore() StateStore {
+	return &memoryStore{state: newStoreState()}
+}
+
+func (s *memoryStore) GetInstance(id string) (*Instance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if i, ok := s.state.Instances[id]; ok {
+		return &i, nil
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) Instances() ([]Instance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	instances := make([]Instance, 0, len(s.state.Instances))
+	for _, i := range s.state.Instances {
+		instances = append(instances, i)
+	}
+	return instances, nil
+}
+
+func (s *memoryStore) PutInstance(i Instance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.state.Instances[i.Id]
+	s.state.Instances[i.Id] = i
+	if err := s.save(); err != nil {
+		if existed {
+			s.state.Instances[i.Id] = prev
+		} else {
+			delete(s.state.Instances, i.Id)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteInstance(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.state
+	s.state = newStoreState()
+	for k, v := range prev.Instances {
+		if k != id {
+			s.state.Instances[k] = v
+		}
+	}
+	for k, v := range prev.Bindings {
+		if v.InstanceId != id {
+			s.state.Bindings[k] = v
+		}
+	}
+	if err := s.save(); err != nil {
+		s.state = prev
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStore) GetBinding(id string) (*Binding, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if b, ok := s.state.Bindings[id]; ok {
+		return &b, nil
+	}
+	return nil, nil
+}
+
+func (s *memoryStore) Bindings(instanceId string) ([]Binding, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var bindings []Binding
+	for _, b := range s.state.Bindings {
+		if b.InstanceId == instanceId {
+			bindings = append(bindings, b)
+		}
+	}
+	return bindings, nil
+}
+
+func (s *memoryStore) PutBinding(b Binding) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.state.Bindings[b.Id]
+	s.state.Bindings[b.Id] = b
+	if err := s.save(); err != nil {
+		if existed {
+			s.state.Bindings[b.Id] = prev
+		} else {
+			delete(s.state.Bindings, b.Id)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteBinding(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.state.Bindings[id]
+	if !existed {
+		return nil
+	}
+	delete(s.state.Bindings, id)
+	if err := s.save(); err != nil {
+		s.state.Bindings[id] = prev
+		return err
+	}
+	return nil
+}
+
+func (s *memoryStore) save() error {
+	if s.persist == nil {
+		return nil
+	}
+	return s.persist(s.state)
+}
@@ -0,0 +1,90 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// Serves the broker's certificate and swaps it for a freshly loaded one on
+// reload, so renewed certificates are picked up without closing the
+// listener.
+type certReloader struct {
+	mu       sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = &cert
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.cert, nil
+}
+
+// Returns the TLS configuration of the listener, or nil if the broker
+// serves plain HTTP. With a client CA configured, callers such as the Cloud
+// Controller must present a certificate signed by it.
+func newTLSConfig(o Options) (*tls.Config, *certReloader, error) {
+	if o.TLSCertFile == "" && o.TLSKeyFile == "" {
+		if o.TLSClientCAFile != "" {
+			return nil, nil, errors.New("Client certificates require 'tlsCertFile' and 'tlsKeyFile'")
+		}
+		return nil, nil, nil
+	}
+	if o.TLSCertFile == "" || o.TLSKeyFile == "" {
+		return nil, nil, errors.New("Both 'tlsCertFile' and 'tlsKeyFile' must be set")
+	}
+
+	certs, err := newCertReloader(o.TLSCertFile, o.TLSKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot load TLS certificate: %v", err)
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+
+	if o.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(o.TLSClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Cannot read client CA file '%v': %v", o.TLSClientCAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("No certificates found in client CA file '%v'", o.TLSClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, certs, nil
+}
@@ -4,27 +4,55 @@
 
 package broker
 
+import (
+	"net/http"
+)
+
 // The BrokerService defines the internal API used by the broker's HTTP endpoints.
 type BrokerService interface {
 
+	// Returns the name of the zone served by this Broker Service.
+	Zone() string
+
 	// Exposes the catalog of services managed by this broker.
 	// Returns the exposed catalog.
 	Catalog() (Catalog, error)
 
 	// Creates a service instance of a specified service and plan.
-	// Returns the optional management URL.
-	Provision(ProvisioningRequest) (string, error)
+	// Returns the optional management endpoint of the instance. It is kept
+	// by the broker and only reached through the dashboard proxy, never
+	// handed to the Cloud Controller.
+	Provision(ProvisioningRequest) (*Management, error)
+
+	// Returns the transport used to reach management endpoints, or nil to
+	// use the default transport.
+	ManagementTransport() http.RoundTripper
 
-	// Removes created service instance.
-	Deprovision(ProvisioningRequest) error
+	// Removes created service instance together with the given generations
+	// of its management user.
+	Deprovision(ProvisioningRequest, []int) error
 
 	// Binds to specified service instance.
 	// Returns  credentials necessary to establish connection to this
 	// service instance as well as optional syslog drain URL.
 	Bind(BindingRequest) (string, Credentials, string, error)
 
-	// Removes created binding.
-	Unbind(BindingRequest) error
+	// Removes the given generations of the binding's user.
+	Unbind(BindingRequest, []int) error
+
+	// Creates the management user of the given generation with a new
+	// password, leaving the previous generation untouched.
+	RotateManagement(ProvisioningRequest, int) (*Management, error)
+
+	// Removes the management user of the given generation.
+	RetireManagement(ProvisioningRequest, int) error
+
+	// Creates the binding user of the given generation with a new password,
+	// leaving the previous generation untouched. Returns its credentials.
+	RotateBinding(BindingRequest, int) (Credentials, error)
+
+	// Removes the binding user of the given generation.
+	RetireBinding(BindingRequest, int) error
 }
 
 const (
@@ -32,6 +60,8 @@ const (
 	ErrCodeConflict = 10
 	// Raised by Broker Service if service instance or service instance binding cannot be found
 	ErrCodeGone = 20
+	// Raised by Broker Service if the request refers to an unknown plan or is otherwise invalid
+	ErrCodeBadRequest = 30
 	// Raised by Broker Service for any other issues
 	ErrCodeOther = 99
 )
@@ -61,6 +91,14 @@ type BindingRequest struct {
 
 type Credentials map[string]interface{}
 
+// Management UI and API of a service instance, with credentials limited to
+// the instance.
+type Management struct {
+	Url      string `json:"url"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#catalog-mgmt
 type Catalog struct {
 	Services []Service `json:"services"`
@@ -68,14 +106,22 @@ type Catalog struct {
 
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#catalog-mgmt
 type Service struct {
-	Id          string                 `json:"id"`
-	Name        string                 `json:"name"`
-	Description string                 `json:"description"`
-	Bindable    bool                   `json:"bindable"`
-	Tags        []string               `json:"tags,omitempty"`
-	Requires    []string               `json:"requires,omitempty"`
-	Plans       []Plan                 `json:"plans"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	Id              string                 `json:"id"`
+	Name            string                 `json:"name"`
+	Description     string                 `json:"description"`
+	Bindable        bool                   `json:"bindable"`
+	Tags            []string               `json:"tags,omitempty"`
+	Requires        []string               `json:"requires,omitempty"`
+	Plans           []Plan                 `json:"plans"`
+	Metadata        map[string]interface{} `json:"metadata,omitempty"`
+	DashboardClient *DashboardClient       `json:"dashboard_client,omitempty"`
+}
+
+// See http://docs.cloudfoundry.com/docs/running/architecture/services/dashboard-sso.html
+type DashboardClient struct {
+	Id          string `json:"id"`
+	Secret      string `json:"secret"`
+	RedirectUri string `json:"redirect_uri"`
 }
 
 // See http://docs.cloudfoundry.com/docs/running/architecture/services/api.html#catalog-mgmt
@@ -0,0 +1,162 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+type zoneFailure struct {
+	zone string
+	err  error
+}
+
+// Error of an operation spanning all zones. Lists the zones the operation
+// failed in and, for operations that were rolled back, the zones that were
+// compensated successfully or not.
+type zoneError struct {
+	op               string
+	failures         []zoneFailure
+	rolledBack       []string
+	rollbackFailures []zoneFailure
+}
+
+// Returns the code shared by all failures, so that e.g. a deprovisioning
+// that is gone in every zone is still reported as gone.
+func (e *zoneError) Code() int {
+	code := ErrCodeOther
+	for i, f := range e.failures {
+		c := ErrCodeOther
+		if err, ok := f.err.(BrokerServiceError); ok {
+			c = err.Code()
+		}
+		if i > 0 && c != code {
+			return ErrCodeOther
+		}
+		code = c
+	}
+	return code
+}
+
+func (e *zoneError) Error() string {
+	msg := fmt.Sprintf("%v failed in zone(s) %v", e.op, describeFailures(e.failures))
+	if len(e.rolledBack) > 0 {
+		msg += fmt.Sprintf("; rolled back zone(s) %v", strings.Join(e.rolledBack, ", "))
+	}
+	if len(e.rollbackFailures) > 0 {
+		msg += fmt.Sprintf("; rollback failed in zone(s) %v", describeFailures(e.rollbackFailures))
+	}
+	return msg
+}
+
+func (e *zoneError) entity() interface{} {
+	return struct {
+		Description         string            `json:"description"`
+		FailedZones         map[string]string `json:"failed_zones"`
+		RolledBackZones     []string          `json:"rolled_back_zones,omitempty"`
+		RollbackFailedZones map[string]string `json:"rollback_failed_zones,omitempty"`
+	}{e.Error(), failureMap(e.failures), e.rolledBack, failureMap(e.rollbackFailures)}
+}
+
+func describeFailures(failures []zoneFailure) string {
+	descs := make([]string, len(failures))
+	for i, f := range failures {
+		descs[i] = fmt.Sprintf("%v (%v)", f.zone, f.err)
+	}
+	return strings.Join(descs, ", ")
+}
+
+func failureMap(failures []zoneFailure) map[string]string {
+	if len(failures) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(failures))
+	for _, f := range failures {
+		m[f.zone] = f.err.Error()
+	}
+	return m
+}
+
+// Runs the action in every zone in order. When a zone fails, or ctx is done
+// before the next zone, the zones done so far are compensated in reverse
+// order and a *zoneError is returned.
+func inAllZones(ctx context.Context, op string, bs []BrokerService, action, compensate func(BrokerService) error) error {
+	for i, brokerService := range bs {
+		err := ctx.Err()
+		if err != nil {
+			err = fmt.Errorf("Aborted: %v", err)
+		} else {
+			err = action(brokerService)
+		}
+		if err != nil {
+			handlerLog.Errorf("%v failed in zone [%v]: %v", op, brokerService.Zone(), err)
+			e := &zoneError{op: op, failures: []zoneFailure{{brokerService.Zone(), err}}}
+			e.compensate(bs[:i], compensate)
+			return e
+		}
+	}
+	return nil
+}
+
+// Runs the action in every zone regardless of failures in other zones. Used
+// for removals, which cannot be compensated. Returns a *zoneError listing
+// every zone that failed.
+func inEachZone(op string, bs []BrokerService, action func(BrokerService) error) error {
+	e := &zoneError{op: op}
+	for _, brokerService := range bs {
+		if err := action(brokerService); err != nil {
+			handlerLog.Errorf("%v failed in zone [%v]: %v", op, brokerService.Zone(), err)
+			e.failures = append(e.failures, zoneFailure{brokerService.Zone(), err})
+		}
+	}
+	if len(e.failures) > 0 {
+		return e
+	}
+	return nil
+}
+
+func (e *zoneError) compensate(done []BrokerService, compensate func(BrokerService) error) {
+	for i := len(done) - 1; i >= 0; i-- {
+		zone := done[i].Zone()
+		if err := compensate(done[i]); err != nil {
+			handlerLog.Errorf("Rollback of %v failed in zone [%v]: %v", strings.ToLower(e.op), zone, err)
+			e.rollbackFailures = append(e.rollbackFailures, zoneFailure{zone, err})
+		} else {
+			handlerLog.Printf("Rolled back %v in zone [%v]", strings.ToLower(e.op), zone)
+			e.rolledBack = append(e.rolledBack, zone)
+		}
+	}
+}
+
+func isGone(err error) bool {
+	e, ok := err.(BrokerServiceError)
+	return ok && e.Code() == ErrCodeGone
+}
+
+// Drops the zones that failed only because there was nothing left to
+// remove. Returns nil if no other failures remain.
+func ignoreGone(err error) error {
+	e, ok := err.(*zoneError)
+	if !ok {
+		if isGone(err) {
+			return nil
+		}
+		return err
+	}
+	remaining := &zoneError{op: e.op}
+	for _, f := range e.failures {
+		if isGone(f.err) {
+			handlerLog.Printf("%v: already gone from zone [%v]", e.op, f.zone)
+			continue
+		}
+		remaining.failures = append(remaining.failures, f)
+	}
+	if len(remaining.failures) == 0 {
+		return nil
+	}
+	return remaining
+}
@@ -0,0 +1,133 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package broker
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// A zone which records the calls it gets. Provisioning and binding fail
+// with err if it is set, after waiting for gate to be closed if that is set.
+// Other BrokerService methods are not implemented.
+type fakeZone struct {
+	BrokerService
+	name    string
+	err     error
+	gate    chan struct{}
+	entered chan string // Told about every call waiting for gate
+
+	mu    sync.Mutex
+	calls []string
+}
+
+func (z *fakeZone) Zone() string {
+	return z.name
+}
+
+func fakeZones(names ...string) []BrokerService {
+	bs := make([]BrokerService, len(names))
+	for i, name := range names {
+		bs[i] = &fakeZone{name: name}
+	}
+	return bs
+}
+
+func TestInAllZonesRollsBackInReverse(t *testing.T) {
+	var done, compensated []string
+	err := inAllZones(context.Background(), "Provisioning", fakeZones("a", "b", "c", "d"), func(bs BrokerService) error {
+		if bs.Zone() == "c" {
+			return errors.New("boom")
+		}
+		done = append(done, bs.Zone())
+		return nil
+	}, func(bs BrokerService) error {
+		compensated = append(compensated, bs.Zone())
+		if bs.Zone() == "a" {
+			return errors.New("stuck")
+		}
+		return nil
+	})
+
+	if want := []string{"a", "b"}; !reflect.DeepEqual(done, want) {
+		t.Errorf("Done in %v; want %v", done, want)
+	}
+	if want := []string{"b", "a"}; !reflect.DeepEqual(compensated, want) {
+		t.Errorf("Compensated %v; want %v", compensated, want)
+	}
+	e, ok := err.(*zoneError)
+	if !ok {
+		t.Fatalf("Error %#v; want a *zoneError", err)
+	}
+	if len(e.failures) != 1 || e.failures[0].zone != "c" {
+		t.Errorf("Failures %v; want zone c only", e.failures)
+	}
+	if want := []string{"b"}; !reflect.DeepEqual(e.rolledBack, want) {
+		t.Errorf("Rolled back %v; want %v", e.rolledBack, want)
+	}
+	if len(e.rollbackFailures) != 1 || e.rollbackFailures[0].zone != "a" {
+		t.Errorf("Rollback failures %v; want zone a only", e.rollbackFailures)
+	}
+	if e.Code() != ErrCodeOther {
+		t.Errorf("Code %v; want %v", e.Code(), ErrCodeOther)
+	}
+}
+
+func TestIgnoreGone(t *testing.T) {
+	gone := &fakeServiceError{ErrCodeGone}
+	err := &zoneError{op: "Unbinding", failures: []zoneFailure{{"a", gone}, {"b", gone}}}
+	if err.Code() != ErrCodeGone {
+		t.Errorf("Code %v; want %v", err.Code(), ErrCodeGone)
+	}
+	if got := ignoreGone(err); got != nil {
+		t.Errorf("ignoreGone(%v) = %v; want nil", err, got)
+	}
+
+	err.failures = append(err.failures, zoneFailure{"c", errors.New("boom")})
+	got, ok := ignoreGone(err).(*zoneError)
+	if !ok || len(got.failures) != 1 || got.failures[0].zone != "c" {
+		t.Errorf("ignoreGone(%v) = %v; want a failure in zone c only", err, got)
+	}
+}
+
+type fakeServiceError struct {
+	code int
+}
+
+func (e *fakeServiceError) Code() int {
+	return e.code
+}
+
+func (e *fakeServiceError) Error() string {
+	return "fake"
+}
+
+func TestInAllZonesStopsWhenAborted(t *testing.T) {
+	ctx, abort := context.WithCancel(context.Background())
+	var done, compensated []string
+	err := inAllZones(ctx, "Provisioning", fakeZones("a", "b", "c"), func(bs BrokerService) error {
+		done = append(done, bs.Zone())
+		if bs.Zone() == "b" {
+			abort()
+		}
+		return nil
+	}, func(bs BrokerService) error {
+		compensated = append(compensated, bs.Zone())
+		return nil
+	})
+
+	if want := []string{"a", "b"}; !reflect.DeepEqual(done, want) {
+		t.Errorf("Done in %v; want %v", done, want)
+	}
+	if want := []string{"b", "a"}; !reflect.DeepEqual(compensated, want) {
+		t.Errorf("Compensated %v; want %v", compensated, want)
+	}
+	if e, ok := err.(*zoneError); !ok || len(e.failures) != 1 || e.failures[0].zone != "c" {
+		t.Errorf("Error %v; want a failure in zone c", err)
+	}
+}
@@ -33,25 +33,22 @@ func main() {
 		Version()
 	}
 
-	configFile := flag.Args()[0]
-	file, e := ioutil.ReadFile(configFile)
-	if e != nil {
-		fmt.Printf("Cannot read config file '%v'; %v\n", configFile, e)
-		os.Exit(1)
+	if flag.Arg(0) == "rotate" {
+		rotate(flag.Args()[1:])
+		return
 	}
 
-	configJson := map[string]map[string]interface{}{}
-	err := json.Unmarshal(file, &configJson)
-	if err != nil {
-		fmt.Printf("Cannot parse JSON in '%v'", configFile)
-		os.Exit(1)
-	}
+	configJson := readConfig(flag.Args()[0])
 
 	rabbitmq.PopulateOptions(configJson["rabbitmq"])
 	broker.PopulateOptions(configJson["broker"])
 
+	if err := rabbitmq.LoadCatalog(rabbitmq.Opts.Catalog); err != nil {
+		fmt.Printf("Cannot load catalog '%v'; %v\n", rabbitmq.Opts.Catalog, err)
+		os.Exit(1)
+	}
+
 	brokerServices := make([]broker.BrokerService, len(rabbitmq.Opts.Zones))
-	fmt.Sprintf("%v", len(rabbitmq.Opts.Zones))
 	for k, zoneData := range rabbitmq.Opts.Zones {
 		brokerService, err := rabbitmq.New(zoneData)
 		if err != nil {
@@ -60,8 +57,29 @@ func main() {
 		brokerServices[k] = brokerService
 	}
 
-	broker := broker.New(broker.Opts, brokerServices)
-	broker.Start()
+	broker, err := broker.New(broker.Opts, brokerServices)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := broker.Start(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readConfig(configFile string) map[string]map[string]interface{} {
+	file, e := ioutil.ReadFile(configFile)
+	if e != nil {
+		fmt.Printf("Cannot read config file '%v'; %v\n", configFile, e)
+		os.Exit(1)
+	}
+
+	configJson := map[string]map[string]interface{}{}
+	err := json.Unmarshal(file, &configJson)
+	if err != nil {
+		fmt.Printf("Cannot parse JSON in '%v'", configFile)
+		os.Exit(1)
+	}
+	return configJson
 }
 
 func Usage() {
@@ -81,8 +99,16 @@ RabbitMQ Service Broker v%v
 `, version)
 	usageStr = `
 cf-rabbitmq-broker [config.json path]
+cf-rabbitmq-broker rotate --instance <id> [--binding <id>] [rotate options] [config.json path]
 Common Options:
         --help                         Show this message
         --version                      Show service broker version
+Rotate Options:
+        --instance <id>                Service instance whose management credentials are rotated
+        --binding <id>                 Rotate the credentials of this binding of the instance instead
+        --grace <duration>             Keep the previous credentials valid for this long, e.g. 1h
+        --credentials <name>           Admin credential set to use (first admin set by default)
+        --url <url>                    Broker URL (derived from the config by default)
+        --insecure                     Do not verify the broker's TLS certificate
 `
 )
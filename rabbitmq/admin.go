@@ -5,12 +5,14 @@
 package rabbitmq
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/mitchellh/mapstructure"
 	"github.com/FreightTrain/cf-rabbitmq-broker/broker"
 	"github.com/nimbus-cloud/rabbit-hole"
 	"net/http"
+	"net/url"
 )
 
 type rabbitAdminError struct {
@@ -26,15 +28,25 @@ func (e *rabbitAdminError) Error() string {
 }
 
 type rabbitAdmin struct {
-	client *rabbithole.Client
+	client     *rabbithole.Client
+	httpClient *http.Client // For management API calls not covered by Rabbit-Hole
+	hashing    string       // Password hashing algorithm of the cluster
 }
 
-func newRabbitAdmin(brokerUrl, username, password string) (*rabbitAdmin, error) {
-	client, err := rabbithole.NewClient(brokerUrl, username, password)
+// Creates a management API client. A nil transport selects plain HTTP.
+func newRabbitAdmin(brokerUrl, username, password string, transport *http.Transport) (*rabbitAdmin, error) {
+	if transport == nil {
+		client, err := rabbithole.NewClient(brokerUrl, username, password)
+		if err != nil {
+			return nil, err
+		}
+		return &rabbitAdmin{client: client, httpClient: http.DefaultClient}, nil
+	}
+	client, err := rabbithole.NewTLSClient(brokerUrl, username, password, transport)
 	if err != nil {
 		return nil, err
 	}
-	return &rabbitAdmin{client}, nil
+	return &rabbitAdmin{client: client, httpClient: &http.Client{Transport: transport}}, nil
 }
 
 func (a *rabbitAdmin) isVhost(username string) (bool, error) {
@@ -81,7 +93,25 @@ func (a *rabbitAdmin) isUser(username string) (bool, error) {
 	return false, &rabbitAdminError{broker.ErrCodeOther, err}
 }
 
-func (a *rabbitAdmin) createUser(username, password string) error {
+func (a *rabbitAdmin) setVhostLimit(vhostname, limit string, value int) error {
+	path := fmt.Sprintf("/api/vhost-limits/%v/%v", url.PathEscape(vhostname), limit)
+	req, err := a.newRequest("PUT", path, map[string]interface{}{"value": value})
+	if err != nil {
+		return err
+	}
+	return a.send(req)
+}
+
+func (a *rabbitAdmin) setVhostDefaultQueueType(vhostname, queueType string) error {
+	path := fmt.Sprintf("/api/vhosts/%v", url.PathEscape(vhostname))
+	req, err := a.newRequest("PUT", path, map[string]interface{}{"default_queue_type": queueType})
+	if err != nil {
+		return err
+	}
+	return a.send(req)
+}
+
+func (a *rabbitAdmin) createUser(username, password, tags string) error {
 	if found, err := a.isUser(username); err != nil {
 		return err
 	} else if found {
@@ -89,16 +119,22 @@ func (a *rabbitAdmin) createUser(username, password string) error {
 		return &rabbitAdminError{broker.ErrCodeConflict, errors.New(msg)}
 	}
 
-	settings := rabbithole.UserSettings{
-		Name:     username,
-		Password: password,
-		Tags:     "management, policymaker, monitoring",
-	}
-	resp, err := a.client.PutUser(username, settings)
+	// Only the hash is sent, so the password never reaches the management
+	// API or its logs.
+	passwordHash, algorithm, err := hashPassword(password, a.hashing)
 	if err != nil {
 		return &rabbitAdminError{broker.ErrCodeOther, err}
 	}
-	return checkResponseAndClose(resp)
+	path := fmt.Sprintf("/api/users/%v", url.PathEscape(username))
+	req, err := a.newRequest("PUT", path, map[string]interface{}{
+		"password_hash":     passwordHash,
+		"hashing_algorithm": algorithm,
+		"tags":              tags,
+	})
+	if err != nil {
+		return err
+	}
+	return a.send(req)
 }
 
 func (a *rabbitAdmin) deleteUser(username string) error {
@@ -118,9 +154,39 @@ func (a *rabbitAdmin) grantAllPermissionsIn(username, vhostname string) error {
 	return checkResponseAndClose(resp)
 }
 
-func (a *rabbitAdmin) setFederationUpstream(vhost string, upstreamName string, fOpts map[string]interface{}) error {
-	var fDef rabbithole.FederationDefinition
-	err := mapstructure.Decode(fOpts, &fDef)
+// Force-closes all connections accepted by the predicate, giving the reason
+// to the clients. Returns the number of connections closed.
+func (a *rabbitAdmin) closeConnections(match func(rabbithole.ConnectionInfo) bool, reason string) (int, error) {
+	conns, err := a.client.ListConnections()
+	if err != nil {
+		return 0, &rabbitAdminError{broker.ErrCodeOther, err}
+	}
+	closed := 0
+	for _, conn := range conns {
+		if !match(conn) {
+			continue
+		}
+		if err := a.closeConnection(conn.Name, reason); err != nil {
+			if isGone(err) {
+				continue // Closed meanwhile
+			}
+			return closed, err
+		}
+		closed++
+	}
+	return closed, nil
+}
+
+func (a *rabbitAdmin) closeConnection(name, reason string) error {
+	req, err := a.newRequest("DELETE", "/api/connections/"+url.PathEscape(name), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Reason", reason)
+	return a.send(req)
+}
+
+func (a *rabbitAdmin) setFederationUpstream(vhost string, upstreamName string, fDef rabbithole.FederationDefinition) error {
 	resp, err := a.client.PutFederationUpstream(vhost, upstreamName, fDef)
 	if err != nil {
 		return &rabbitAdminError{broker.ErrCodeOther, err}
@@ -128,16 +194,43 @@ func (a *rabbitAdmin) setFederationUpstream(vhost string, upstreamName string, f
 	return checkResponseAndClose(resp)
 }
 
-func (a *rabbitAdmin) setFederationPolicy(vhost string, policyName string, pOpts map[string]interface{}) error {
-	var pDef rabbithole.Policy
-	err := mapstructure.Decode(pOpts, &pDef)
-	resp, err := a.client.PutPolicy(vhost, policyName, pDef)
+func (a *rabbitAdmin) setPolicy(vhost string, policyName string, policy rabbithole.Policy) error {
+	resp, err := a.client.PutPolicy(vhost, policyName, policy)
 	if err != nil {
 		return &rabbitAdminError{broker.ErrCodeOther, err}
 	}
 	return checkResponseAndClose(resp)
 }
 
+func (a *rabbitAdmin) newRequest(method, path string, body interface{}) (*http.Request, error) {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			return nil, &rabbitAdminError{broker.ErrCodeOther, err}
+		}
+	}
+	req, err := http.NewRequest(method, a.client.Endpoint+path, &buf)
+	if err != nil {
+		return nil, &rabbitAdminError{broker.ErrCodeOther, err}
+	}
+	req.SetBasicAuth(a.client.Username, a.client.Password)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (a *rabbitAdmin) send(req *http.Request) error {
+	resp, err := a.httpClient.Do(req)
+	if err != nil {
+		return &rabbitAdminError{broker.ErrCodeOther, err}
+	}
+	return checkResponseAndClose(resp)
+}
+
+func isGone(err error) bool {
+	e, ok := err.(*rabbitAdminError)
+	return ok && e.code == broker.ErrCodeGone
+}
+
 func checkResponseAndClose(resp *http.Response) error {
 	defer resp.Body.Close()
 
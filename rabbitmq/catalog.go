@@ -0,0 +1,149 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/FreightTrain/cf-rabbitmq-broker/broker"
+	"github.com/ghodss/yaml"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Catalog exposed when no catalog file is configured.
+var defaultCatalog = broker.Catalog{
+	Services: []broker.Service{
+		broker.Service{
+			Id:          "rabbitmq",
+			Name:        "rabbitmq",
+			Description: "RabbitMQ Message Broker",
+			Bindable:    true,
+			Tags:        []string{"rabbitmq", "messaging"},
+			Plans: []broker.Plan{
+				broker.Plan{
+					Id:          "default",
+					Name:        "default",
+					Description: "Default RabbitMQ plan represented as a unique broker's vhost.",
+				},
+			},
+		},
+	},
+}
+
+var catalog = defaultCatalog
+
+// Broker-only part of the catalog file: the 'rabbitmq' section of each plan.
+type catalogDefinitions struct {
+	Services []struct {
+		Plans []struct {
+			Id         string         `json:"id"`
+			Definition PlanDefinition `json:"rabbitmq"`
+		} `json:"plans"`
+	} `json:"services"`
+}
+
+// Loads the service catalog from the given JSON or YAML file (chosen by the
+// '.yml'/'.yaml' extension) and validates it together with the plan
+// definitions it carries. An empty path keeps the default catalog.
+func LoadCatalog(path string) error {
+	if path == "" {
+		return plans["default"].validate()
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		if data, err = yaml.YAMLToJSON(data); err != nil {
+			return err
+		}
+	}
+
+	var cat broker.Catalog
+	if err := json.Unmarshal(data, &cat); err != nil {
+		return err
+	}
+	if err := validateCatalog(cat); err != nil {
+		return err
+	}
+
+	var defs catalogDefinitions
+	if err := json.Unmarshal(data, &defs); err != nil {
+		return err
+	}
+	planDefs := make(map[string]PlanDefinition)
+	for i, s := range defs.Services {
+		drains := false
+		for _, p := range s.Plans {
+			if err := p.Definition.validate(); err != nil {
+				return fmt.Errorf("Plan [%v]: %v", p.Id, err)
+			}
+			planDefs[p.Id] = p.Definition
+			drains = drains || p.Definition.SyslogDrainUrl != ""
+		}
+		// The Cloud Controller accepts drain URLs only from services requiring them
+		if drains && !contains(cat.Services[i].Requires, "syslog_drain") {
+			cat.Services[i].Requires = append(cat.Services[i].Requires, "syslog_drain")
+		}
+	}
+
+	catalog, plans = cat, planDefs
+	return nil
+}
+
+func validateCatalog(cat broker.Catalog) error {
+	if len(cat.Services) == 0 {
+		return errors.New("Catalog defines no services")
+	}
+	serviceIds := make(map[string]bool)
+	serviceNames := make(map[string]bool)
+	planIds := make(map[string]bool)
+	for i, s := range cat.Services {
+		if s.Id == "" || s.Name == "" || s.Description == "" {
+			return fmt.Errorf("Service #%v: 'id', 'name' and 'description' are required", i+1)
+		}
+		if serviceIds[s.Id] {
+			return fmt.Errorf("Service [%v]: duplicate service id", s.Id)
+		}
+		if serviceNames[s.Name] {
+			return fmt.Errorf("Service [%v]: duplicate service name [%v]", s.Id, s.Name)
+		}
+		serviceIds[s.Id], serviceNames[s.Name] = true, true
+
+		if dc := s.DashboardClient; dc != nil && (dc.Id == "" || dc.Secret == "") {
+			return fmt.Errorf("Service [%v]: dashboard client requires 'id' and 'secret'", s.Id)
+		}
+		if len(s.Plans) == 0 {
+			return fmt.Errorf("Service [%v]: no plans defined", s.Id)
+		}
+		planNames := make(map[string]bool)
+		for j, p := range s.Plans {
+			if p.Id == "" || p.Name == "" || p.Description == "" {
+				return fmt.Errorf("Service [%v]: plan #%v: 'id', 'name' and 'description' are required", s.Id, j+1)
+			}
+			if planIds[p.Id] {
+				return fmt.Errorf("Service [%v]: duplicate plan id [%v]", s.Id, p.Id)
+			}
+			if planNames[p.Name] {
+				return fmt.Errorf("Service [%v]: duplicate plan name [%v]", s.Id, p.Name)
+			}
+			planIds[p.Id], planNames[p.Name] = true, true
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
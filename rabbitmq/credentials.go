@@ -0,0 +1,132 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"fmt"
+	"github.com/FreightTrain/cf-rabbitmq-broker/broker"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// Top-level keys of the binding credentials. Zone credentials are keyed by
+// zone name next to them, so zones must not be named like any of these.
+var credentialKeys = map[string]bool{
+	"hostname":      true,
+	"hostnames":     true,
+	"host":          true,
+	"port":          true,
+	"username":      true,
+	"password":      true,
+	"vhost":         true,
+	"uri":           true,
+	"uris":          true,
+	"ssl":           true,
+	"protocols":     true,
+	"http_api_uri":  true,
+	"http_api_uris": true,
+	"cacert":        true,
+}
+
+// Returns the binding credentials for the zone in the shape common
+// RabbitMQ client libraries and buildpacks expect. The top-level URIs use
+// AMQPS when the zone offers it; 'protocols' lists every protocol the zone
+// exposes so clients can pick the one they speak.
+func (b *RabbitService) credentials(vhost, username, password string) broker.Credentials {
+	protocols := map[string]map[string]interface{}{
+		"amqp": b.protocol("amqp", b.hosts(), b.opts.Port, false, "/"+vhost, vhost, username, password),
+	}
+	if b.opts.TLSPort > 0 {
+		protocols["amqps"] = b.protocol("amqps", b.hosts(), b.opts.TLSPort, true, "/"+vhost, vhost, username, password)
+	}
+	if b.opts.MgmtPort > 0 {
+		scheme := "http"
+		if b.opts.MgmtTLS {
+			scheme = "https"
+		}
+		mgmt := b.protocol(scheme, []string{b.opts.MgmtHost}, b.opts.MgmtPort, b.opts.MgmtTLS, "/api/", "", username, password)
+		mgmt["path"] = "/api/"
+		protocols["management"] = mgmt
+	}
+	if b.opts.MqttPort > 0 {
+		// MQTT selects the vhost by prefixing the username with it
+		mqttUser := fmt.Sprintf("%v:%v", vhost, username)
+		protocols["mqtt"] = b.protocol("mqtt", b.hosts(), b.opts.MqttPort, false, "", "", mqttUser, password)
+	}
+	if b.opts.StompPort > 0 {
+		protocols["stomp"] = b.protocol("stomp", b.hosts(), b.opts.StompPort, false, "", vhost, username, password)
+	}
+
+	primary := protocols["amqp"]
+	if amqps, ok := protocols["amqps"]; ok {
+		primary = amqps
+	}
+
+	creds := broker.Credentials{
+		"hostname":  b.opts.Host,
+		"hostnames": b.hosts(),
+		"host":      b.opts.Host,
+		"port":      primary["port"],
+		"username":  username,
+		"password":  password,
+		"vhost":     vhost,
+		"uri":       primary["uri"],
+		"uris":      primary["uris"],
+		"ssl":       b.opts.TLSPort > 0,
+		"protocols": protocols,
+	}
+	if mgmt, ok := protocols["management"]; ok {
+		creds["http_api_uri"] = mgmt["uri"]
+		creds["http_api_uris"] = mgmt["uris"]
+	}
+	if b.caCert != "" {
+		creds["cacert"] = b.caCert
+	}
+	return creds
+}
+
+// Hosts of the zone's cluster nodes, the primary host first.
+func (b *RabbitService) hosts() []string {
+	hosts := []string{b.opts.Host}
+	for _, h := range b.opts.Hosts {
+		if h != b.opts.Host {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+func (b *RabbitService) protocol(scheme string, hosts []string, port int, ssl bool, path, vhost, username, password string) map[string]interface{} {
+	user := url.UserPassword(username, password)
+	uris := make([]string, len(hosts))
+	for i, host := range hosts {
+		uris[i] = buildUri(scheme, host, port, path, user)
+	}
+	p := map[string]interface{}{
+		"uri":      uris[0],
+		"uris":     uris,
+		"host":     hosts[0],
+		"hosts":    hosts,
+		"port":     port,
+		"username": username,
+		"password": password,
+		"ssl":      ssl,
+	}
+	if vhost != "" {
+		p["vhost"] = vhost
+	}
+	return p
+}
+
+func buildUri(scheme, host string, port int, path string, user *url.Userinfo) string {
+	u := url.URL{
+		Scheme: scheme,
+		User:   user,
+		Host:   net.JoinHostPort(host, strconv.Itoa(port)),
+		Path:   path,
+	}
+	return u.String()
+}
@@ -0,0 +1,15 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import "testing"
+
+func TestZoneNamesClashingWithCredentials(t *testing.T) {
+	for _, name := range []string{"uri", "host", "vhost", "protocols", "cacert"} {
+		if _, err := New(ZoneOptions{Name: name}); err == nil {
+			t.Errorf("New accepted zone name [%v]", name)
+		}
+	}
+}
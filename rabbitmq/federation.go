@@ -0,0 +1,295 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/nimbus-cloud/rabbit-hole"
+	"net/url"
+)
+
+// Federation topology and upstream settings. Configured globally under
+// 'federation' in the broker configuration; a plan's 'federation' section
+// overrides the fields it sets.
+type FederationOptions struct {
+	Enabled         *bool    `json:"enabled"`          // Defaults to true
+	Zones           []string `json:"zones"`            // Federated zones; all zones if empty
+	ExchangePattern string   `json:"exchange_pattern"` // Exchanges and queues to federate
+	QueuePattern    string   `json:"queue_pattern"`    // Further queues to federate; none if empty
+	Priority        int      `json:"priority"`
+	AckMode         string   `json:"ack_mode"`
+	PrefetchCount   int      `json:"prefetch_count"`
+	MaxHops         int      `json:"max_hops"`
+	Expires         int      `json:"expires"`
+	MessageTTL      int      `json:"message_ttl"`
+	ReconnectDelay  int      `json:"reconnect_delay"`
+}
+
+// Settings used for anything left unset; these match what the broker used
+// before federation was configurable.
+var defaultFederation = FederationOptions{
+	ExchangePattern: "^ps\\.",
+	AckMode:         "on-confirm",
+	PrefetchCount:   1,
+	MaxHops:         1,
+	Expires:         36000000,
+	ReconnectDelay:  5,
+}
+
+// Returns the options with the fields set in override replacing their own.
+func (f FederationOptions) merge(override *FederationOptions) FederationOptions {
+	if override == nil {
+		return f
+	}
+	o := *override
+	if o.Enabled != nil {
+		f.Enabled = o.Enabled
+	}
+	if len(o.Zones) > 0 {
+		f.Zones = o.Zones
+	}
+	if o.ExchangePattern != "" {
+		f.ExchangePattern = o.ExchangePattern
+	}
+	if o.QueuePattern != "" {
+		f.QueuePattern = o.QueuePattern
+	}
+	if o.Priority != 0 {
+		f.Priority = o.Priority
+	}
+	if o.AckMode != "" {
+		f.AckMode = o.AckMode
+	}
+	if o.PrefetchCount != 0 {
+		f.PrefetchCount = o.PrefetchCount
+	}
+	if o.MaxHops != 0 {
+		f.MaxHops = o.MaxHops
+	}
+	if o.Expires != 0 {
+		f.Expires = o.Expires
+	}
+	if o.MessageTTL != 0 {
+		f.MessageTTL = o.MessageTTL
+	}
+	if o.ReconnectDelay != 0 {
+		f.ReconnectDelay = o.ReconnectDelay
+	}
+	return f
+}
+
+// Returns the federation settings of a plan.
+func federationFor(plan PlanDefinition) FederationOptions {
+	return defaultFederation.merge(&Opts.Federation).merge(plan.Federation)
+}
+
+func (f FederationOptions) enabled() bool {
+	return f.Enabled == nil || *f.Enabled
+}
+
+// Returns the options of the federated zones other than the given one.
+func (f FederationOptions) peers(zone string) []ZoneOptions {
+	var peers []ZoneOptions
+	for _, z := range Opts.Zones {
+		if z.Name != zone && f.includes(z.Name) {
+			peers = append(peers, z)
+		}
+	}
+	return peers
+}
+
+// Reports whether the zone takes part in federation.
+func (f FederationOptions) includes(zone string) bool {
+	if len(f.Zones) == 0 {
+		return true
+	}
+	for _, z := range f.Zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+func (f FederationOptions) validate() error {
+	if !f.enabled() {
+		return nil
+	}
+	for _, z := range f.Zones {
+		if _, ok := zoneOptions(z); !ok {
+			return fmt.Errorf("Federation refers to unknown zone: [%v]", z)
+		}
+	}
+	if f.ExchangePattern == "" && f.QueuePattern == "" {
+		return errors.New("Federation requires an exchange or queue pattern")
+	}
+	switch f.AckMode {
+	case "on-confirm", "on-publish", "no-ack":
+	default:
+		return fmt.Errorf("Unsupported federation ack mode: [%v]", f.AckMode)
+	}
+	if f.PrefetchCount < 0 || f.MaxHops < 0 || f.Expires < 0 || f.MessageTTL < 0 || f.ReconnectDelay < 0 {
+		return errors.New("Federation settings must not be negative")
+	}
+	return nil
+}
+
+func zoneOptions(name string) (ZoneOptions, bool) {
+	for _, z := range Opts.Zones {
+		if z.Name == name {
+			return z, true
+		}
+	}
+	return ZoneOptions{}, false
+}
+
+// Name of the user the given zone's upstreams use to consume from the
+// instance's vhost in another zone. It exists only in that other zone and
+// may access nothing but the vhost.
+func federationUser(instanceId, zone string) string {
+	return fmt.Sprintf("f-%v-%v", instanceId, zone)
+}
+
+// Sets up the vhost in this zone to federate with the same vhost in every
+// other federated zone. Zones which have not provisioned the vhost yet are
+// skipped; they link up with this zone when they do. Nothing is set up
+// unless there is another federated zone.
+func (b *RabbitService) federate(vhost string, plan PlanDefinition) error {
+	fed := federationFor(plan)
+	peers := fed.peers(b.opts.Name)
+	if !fed.enabled() || !fed.includes(b.opts.Name) || len(peers) == 0 {
+		return nil
+	}
+
+	// Only one policy applies to a queue, so the plan's queue policy is
+	// folded into the federation policies, which must take precedence.
+	definition := rabbithole.PolicyDefinition{"federation-upstream-set": "all"}
+	priority := fed.Priority
+	if qp := plan.QueuePolicy; qp != nil {
+		for k, v := range qp.definition() {
+			definition[k] = v
+		}
+		if priority <= qp.Priority {
+			priority = qp.Priority + 1
+		}
+	}
+	if fed.ExchangePattern != "" {
+		// Queues matching the exchange pattern are federated too, as they
+		// always were
+		if err := setFederationPolicy(b.admin, vhost, "p", fed.ExchangePattern, "all", priority, definition); err != nil {
+			return err
+		}
+	}
+	if fed.QueuePattern != "" {
+		if err := setFederationPolicy(b.admin, vhost, "fq", fed.QueuePattern, "queues", priority+1, definition); err != nil {
+			return err
+		}
+	}
+
+	for _, zoneOpts := range peers {
+		remote, err := getAdminClient(zoneOpts, zoneOpts.MgmtUser, zoneOpts.MgmtPass)
+		if err != nil {
+			return err
+		}
+		if found, err := remote.isVhost(vhost); err != nil {
+			return err
+		} else if !found {
+			serviceLog.Debugf("Virtual host not yet provisioned in zone [%v], not federating: [%v]", zoneOpts.Name, vhost)
+			continue
+		}
+
+		if err := b.link(b.admin, b.opts, remote, zoneOpts, vhost, plan); err != nil {
+			return err
+		}
+		if err := b.link(remote, zoneOpts, b.admin, b.opts, vhost, plan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lets the downstream zone's vhost consume from the upstream zone's vhost:
+// creates the downstream zone's federation user in the upstream zone and
+// sets an upstream using its credentials in the downstream zone.
+func (b *RabbitService) link(down *rabbitAdmin, downZone ZoneOptions, up *rabbitAdmin, upZone ZoneOptions, vhost string, plan PlanDefinition) error {
+	fed := federationFor(plan)
+	username := federationUser(vhost, downZone.Name)
+	password, err := b.generatePassword(plan)
+	if err != nil {
+		return err
+	}
+
+	// A user left behind by an earlier attempt is replaced
+	if err := up.deleteUser(username); err != nil && !isGone(err) {
+		return err
+	}
+	if err := up.createUser(username, password, ""); err != nil {
+		return err
+	}
+	if err := up.grantAllPermissionsIn(username, vhost); err != nil {
+		up.deleteUser(username)
+		return err
+	}
+	serviceLog.Printf("Federation user created in zone [%v]: [%v]", upZone.Name, username)
+
+	upstreamName := fmt.Sprintf("f-%v", upZone.Name)
+	upstreamUri := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword(username, password),
+		Host:   fmt.Sprintf("%v:%v", upZone.Host, upZone.Port),
+		Path:   "/" + vhost,
+	}
+	upstream := rabbithole.FederationDefinition{
+		Uri:            upstreamUri.String(),
+		Expires:        fed.Expires,
+		MessageTTL:     int32(fed.MessageTTL),
+		MaxHops:        fed.MaxHops,
+		PrefetchCount:  fed.PrefetchCount,
+		ReconnectDelay: fed.ReconnectDelay,
+		AckMode:        fed.AckMode,
+	}
+	if err := down.setFederationUpstream(vhost, upstreamName, upstream); err != nil {
+		up.deleteUser(username)
+		return err
+	}
+	serviceLog.Printf("Federation Upstream set in zone [%v] for %v@%v", downZone.Name, vhost, upstreamName)
+	return nil
+}
+
+// Deletes the federation users other zones use to consume from the
+// instance's vhost in this zone. Users which are already gone are skipped.
+func (b *RabbitService) deleteFederationUsers(vhost string) error {
+	for _, zoneOpts := range Opts.Zones {
+		if zoneOpts.Name == b.opts.Name {
+			continue
+		}
+		username := federationUser(vhost, zoneOpts.Name)
+		if err := b.admin.deleteUser(username); isGone(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		serviceLog.Printf("Federation user deleted: [%v]", username)
+	}
+	return nil
+}
+
+func setFederationPolicy(admin *rabbitAdmin, vhost, prefix, pattern, applyTo string, priority int, definition rabbithole.PolicyDefinition) error {
+	policyName := fmt.Sprintf("%v-%v", prefix, vhost)
+	policy := rabbithole.Policy{
+		Vhost:      vhost,
+		Pattern:    pattern,
+		ApplyTo:    applyTo,
+		Name:       policyName,
+		Priority:   priority,
+		Definition: definition,
+	}
+	if err := admin.setPolicy(vhost, policyName, policy); err != nil {
+		return err
+	}
+	serviceLog.Printf("Federation Policy set for %v: [%v]", vhost, policyName)
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Password hashing algorithms of RabbitMQ by the name used in the zone
+// options. See https://www.rabbitmq.com/passwords.html#computing-password-hash
+var hashingAlgorithms = map[string]struct {
+	module string
+	hash   func() hash.Hash
+}{
+	"sha256": {"rabbit_password_hashing_sha256", sha256.New},
+	"sha512": {"rabbit_password_hashing_sha512", sha512.New},
+}
+
+// RabbitMQ's default since 3.6.
+const defaultPasswordHashing = "sha256"
+
+// Computes the hash RabbitMQ stores for a password: a random 32-bit salt
+// followed by the hash of salt and password, base64-encoded. Returns it
+// together with the name of the hashing module.
+func hashPassword(password, algorithm string) (string, string, error) {
+	if algorithm == "" {
+		algorithm = defaultPasswordHashing
+	}
+	alg, ok := hashingAlgorithms[algorithm]
+	if !ok {
+		return "", "", fmt.Errorf("Unsupported password hashing algorithm: [%v]", algorithm)
+	}
+
+	salt := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", "", err
+	}
+	h := alg.hash()
+	h.Write(salt)
+	h.Write([]byte(password))
+	return base64.StdEncoding.EncodeToString(h.Sum(salt)), alg.module, nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	tests := []struct {
+		algorithm, module string
+		size              int
+	}{
+		{"", "rabbit_password_hashing_sha256", 32},
+		{"sha256", "rabbit_password_hashing_sha256", 32},
+		{"sha512", "rabbit_password_hashing_sha512", 64},
+	}
+	for _, test := range tests {
+		hash, module, err := hashPassword("s3cr3t", test.algorithm)
+		if err != nil {
+			t.Errorf("%q: %v", test.algorithm, err)
+			continue
+		}
+		if module != test.module {
+			t.Errorf("%q: module %v; want %v", test.algorithm, module, test.module)
+		}
+		raw, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil || len(raw) != 4+test.size {
+			t.Errorf("%q: hash %q is not a base64-encoded salt and %v byte digest", test.algorithm, hash, test.size)
+			continue
+		}
+
+		// RabbitMQ verifies by hashing the salt followed by the password
+		name := test.algorithm
+		if name == "" {
+			name = defaultPasswordHashing
+		}
+		h := hashingAlgorithms[name].hash()
+		h.Write(raw[:4])
+		h.Write([]byte("s3cr3t"))
+		if !bytes.Equal(h.Sum(nil), raw[4:]) {
+			t.Errorf("%q: hash %q does not match the password", test.algorithm, hash)
+		}
+	}
+}
+
+func TestHashPasswordSalts(t *testing.T) {
+	a, _, _ := hashPassword("s3cr3t", "sha256")
+	b, _, _ := hashPassword("s3cr3t", "sha256")
+	if a == b {
+		t.Errorf("Equal hashes %q for two hashings; want random salts", a)
+	}
+}
+
+func TestHashPasswordRejectsUnknownAlgorithms(t *testing.T) {
+	for _, algorithm := range []string{"md5", "SHA256", "bcrypt"} {
+		if _, _, err := hashPassword("s3cr3t", algorithm); err == nil {
+			t.Errorf("%q: hashPassword succeeded", algorithm)
+		}
+	}
+}
@@ -11,21 +11,39 @@ import (
 var Opts Options = Options{}
 
 type ZoneOptions struct {
-	Name     string
-	Host     string
-	Port     int
-	MgmtHost string
-	MgmtPort int
-	MgmtUser string
-	MgmtPass string
-	Trace    bool // TODO: Create Rabbit-Hole PR to enable such tracing
+	Name            string
+	Host            string
+	Hosts           []string // Further cluster nodes advertised to bound apps
+	Port            int
+	TLSPort         int    // AMQPS port; bindings prefer AMQPS when set
+	CACert          string // Path to a PEM file of the CAs signing the AMQPS certificate, passed on to bound apps
+	MqttPort        int
+	StompPort       int
+	MgmtHost        string
+	MgmtPort        int
+	MgmtUser        string
+	MgmtPass        string
+	MgmtTLS         bool   // Reach the management API over HTTPS
+	MgmtCACert      string // Path to a PEM file of the CAs trusted for the management API
+	MgmtClientCert  string
+	MgmtClientKey   string
+	MgmtSkipVerify  bool   // Do not verify the management API certificate; for testing only
+	PasswordHashing string // Password hashing algorithm of the cluster: sha256 (default) or sha512
+	Trace           bool   // TODO: Create Rabbit-Hole PR to enable such tracing
 }
 
 type Options struct {
-	Catalog string
-	Zones   []ZoneOptions
+	Catalog     string
+	CloseReason string // Reported to clients whose connections are closed on unbind/deprovision
+	Federation  FederationOptions
+	Zones       []ZoneOptions
 }
 
+const defaultCloseReason = "Closed by the service broker"
+
 func PopulateOptions(opts map[string]interface{}) {
 	mapstructure.Decode(opts, &Opts)
+	if Opts.CloseReason == "" {
+		Opts.CloseReason = defaultCloseReason
+	}
 }
@@ -0,0 +1,168 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/FreightTrain/cf-rabbitmq-broker/broker"
+	"net/url"
+	"strings"
+)
+
+// Tags granted to users created for a service instance unless the plan
+// says otherwise.
+var defaultUserTags = []string{"management"}
+
+// Tags a plan may grant; anything broader, 'monitoring' included, would
+// give tenants access beyond their own virtual host.
+var allowedUserTags = map[string]bool{
+	"management":  true,
+	"policymaker": true,
+}
+
+// Describes how a catalog plan is realised on the RabbitMQ cluster. It is
+// read from the 'rabbitmq' section of each plan in the catalog file and is
+// never exposed to the Cloud Controller.
+type PlanDefinition struct {
+	MaxConnections int                    `json:"max_connections"`
+	MaxQueues      int                    `json:"max_queues"`
+	QueueType      string                 `json:"queue_type"`
+	QueuePolicy    *QueuePolicy           `json:"queue_policy"`
+	UserTags       []string               `json:"user_tags"`
+	SyslogDrainUrl string                 `json:"syslog_drain_url"`
+	Federation     *FederationOptions     `json:"federation"`
+	PasswordPolicy *broker.PasswordPolicy `json:"password_policy"`
+}
+
+// Default policy applied to every queue declared in the instance's vhost.
+type QueuePolicy struct {
+	Pattern        string      `json:"pattern"`
+	Priority       int         `json:"priority"`
+	MessageTTL     int         `json:"message_ttl"`
+	MaxLength      int         `json:"max_length"`
+	MaxLengthBytes int         `json:"max_length_bytes"`
+	Overflow       string      `json:"overflow"`
+	HaMode         string      `json:"ha_mode"`
+	HaParams       interface{} `json:"ha_params"`
+	HaSyncMode     string      `json:"ha_sync_mode"`
+}
+
+// Plan definitions by plan id.
+var plans = map[string]PlanDefinition{
+	"default": PlanDefinition{},
+}
+
+func lookupPlan(planId string) (PlanDefinition, error) {
+	if def, ok := plans[planId]; ok {
+		return def, nil
+	}
+	msg := fmt.Sprintf("Unknown plan: [%v]", planId)
+	return PlanDefinition{}, &rabbitAdminError{broker.ErrCodeBadRequest, errors.New(msg)}
+}
+
+// Placeholders expanded in a plan's syslog drain URL.
+const (
+	instanceIdPlaceholder = "{instance_id}"
+	bindingIdPlaceholder  = "{binding_id}"
+	appIdPlaceholder      = "{app_id}"
+)
+
+// Returns the plan's syslog drain URL for the binding, or an empty string
+// if the plan does not drain logs.
+func (d PlanDefinition) syslogDrainUrl(br broker.BindingRequest) string {
+	return strings.NewReplacer(
+		instanceIdPlaceholder, url.PathEscape(br.InstanceId),
+		bindingIdPlaceholder, url.PathEscape(br.BindingId),
+		appIdPlaceholder, url.PathEscape(br.AppId),
+	).Replace(d.SyslogDrainUrl)
+}
+
+func (d PlanDefinition) userTags() string {
+	if len(d.UserTags) == 0 {
+		return strings.Join(defaultUserTags, ", ")
+	}
+	return strings.Join(d.UserTags, ", ")
+}
+
+// Returns the policy definition keys understood by RabbitMQ.
+func (p *QueuePolicy) definition() map[string]interface{} {
+	def := make(map[string]interface{})
+	if p.MessageTTL > 0 {
+		def["message-ttl"] = p.MessageTTL
+	}
+	if p.MaxLength > 0 {
+		def["max-length"] = p.MaxLength
+	}
+	if p.MaxLengthBytes > 0 {
+		def["max-length-bytes"] = p.MaxLengthBytes
+	}
+	if p.Overflow != "" {
+		def["overflow"] = p.Overflow
+	}
+	if p.HaMode != "" {
+		def["ha-mode"] = p.HaMode
+		if p.HaParams != nil {
+			def["ha-params"] = p.HaParams
+		}
+		if p.HaSyncMode != "" {
+			def["ha-sync-mode"] = p.HaSyncMode
+		}
+	}
+	return def
+}
+
+func (d PlanDefinition) validate() error {
+	if d.MaxConnections < 0 || d.MaxQueues < 0 {
+		return errors.New("'max_connections' and 'max_queues' must not be negative")
+	}
+	switch d.QueueType {
+	case "", "classic", "quorum":
+	default:
+		return fmt.Errorf("Unsupported 'queue_type': [%v]", d.QueueType)
+	}
+	for _, tag := range d.UserTags {
+		if !allowedUserTags[tag] {
+			return fmt.Errorf("User tag not allowed: [%v]", tag)
+		}
+	}
+	if d.SyslogDrainUrl != "" {
+		u, err := url.Parse(d.syslogDrainUrl(broker.BindingRequest{InstanceId: "i", BindingId: "b", AppId: "a"}))
+		if err != nil {
+			return fmt.Errorf("Invalid 'syslog_drain_url': %v", err)
+		}
+		switch u.Scheme {
+		case "syslog", "syslog-tls", "https":
+		default:
+			return fmt.Errorf("Unsupported 'syslog_drain_url' scheme: [%v]", u.Scheme)
+		}
+	}
+	if err := federationFor(d).validate(); err != nil {
+		return err
+	}
+	if d.PasswordPolicy != nil {
+		if _, err := broker.NewPasswordGenerator(*d.PasswordPolicy); err != nil {
+			return fmt.Errorf("Invalid 'password_policy': %v", err)
+		}
+	}
+	if p := d.QueuePolicy; p != nil {
+		switch p.HaMode {
+		case "", "all":
+		case "exactly", "nodes":
+			if p.HaParams == nil {
+				return fmt.Errorf("'ha_mode' [%v] requires 'ha_params'", p.HaMode)
+			}
+		default:
+			return fmt.Errorf("Unsupported 'ha_mode': [%v]", p.HaMode)
+		}
+		if p.HaMode != "" && d.QueueType == "quorum" {
+			return errors.New("'ha_mode' cannot be combined with quorum queues")
+		}
+		if len(p.definition()) == 0 {
+			return errors.New("'queue_policy' defines no policy keys")
+		}
+	}
+	return nil
+}
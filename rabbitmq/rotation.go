@@ -0,0 +1,117 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/FreightTrain/cf-rabbitmq-broker/broker"
+	"github.com/nimbus-cloud/rabbit-hole"
+)
+
+// Credentials are rotated by creating a user of the next generation, so
+// the previous user keeps working until it is retired. Generation 0 is
+// the user created by Provision or Bind and carries no suffix.
+func userGeneration(base string, generation int) string {
+	if generation == 0 {
+		return base
+	}
+	return fmt.Sprintf("%v-%v", base, generation)
+}
+
+// Returns the names of the given generations of the base user.
+func userGenerations(base string, generations []int) []string {
+	names := make([]string, len(generations))
+	for i, g := range generations {
+		names[i] = userGeneration(base, g)
+	}
+	return names
+}
+
+func (b *RabbitService) RotateManagement(pr broker.ProvisioningRequest, generation int) (*broker.Management, error) {
+	plan, err := lookupPlan(pr.PlanId)
+	if err != nil {
+		return nil, err
+	}
+	username := managementUser(pr.InstanceId, generation)
+	password, err := b.createRotatedUser(username, pr.InstanceId, plan)
+	if err != nil {
+		return nil, err
+	}
+	return &broker.Management{Url: b.admin.client.Endpoint, Username: username, Password: password}, nil
+}
+
+func (b *RabbitService) RetireManagement(pr broker.ProvisioningRequest, generation int) error {
+	return b.retireUser(managementUser(pr.InstanceId, generation))
+}
+
+func (b *RabbitService) RotateBinding(br broker.BindingRequest, generation int) (broker.Credentials, error) {
+	plan, err := lookupPlan(br.PlanId)
+	if err != nil {
+		return nil, err
+	}
+	username := bindingUser(br.BindingId, generation)
+	password, err := b.createRotatedUser(username, br.InstanceId, plan)
+	if err != nil {
+		return nil, err
+	}
+	return b.credentials(br.InstanceId, username, password), nil
+}
+
+func (b *RabbitService) RetireBinding(br broker.BindingRequest, generation int) error {
+	return b.retireUser(bindingUser(br.BindingId, generation))
+}
+
+func (b *RabbitService) createRotatedUser(username, vhost string, plan PlanDefinition) (string, error) {
+	password, err := b.generatePassword(plan)
+	if err != nil {
+		return "", err
+	}
+	if err := b.admin.createUser(username, password, plan.userTags()); err != nil {
+		return "", err
+	}
+	if err := b.admin.grantAllPermissionsIn(username, vhost); err != nil {
+		b.admin.deleteUser(username)
+		return "", err
+	}
+	serviceLog.Printf("User created by credential rotation on %v: [%v]", b.admin.client.Endpoint, username)
+	return password, nil
+}
+
+// Deletes a user replaced by a rotation and closes its connections.
+func (b *RabbitService) retireUser(username string) error {
+	if err := b.admin.deleteUser(username); err != nil {
+		return err
+	}
+	serviceLog.Printf("Retired user deleted: [%v]", username)
+
+	closed, err := b.admin.closeConnections(func(c rabbithole.ConnectionInfo) bool {
+		return c.User == username
+	}, Opts.CloseReason)
+	if err != nil {
+		return err
+	}
+	serviceLog.Printf("Closed %v connection(s) of retired user: [%v]", closed, username)
+	return nil
+}
+
+// Deletes the given generations of the user. Returns the names of the
+// deleted users, or a Gone error if there were none.
+func (b *RabbitService) deleteUserGenerations(base string, generations []int) ([]string, error) {
+	var deleted []string
+	for _, username := range userGenerations(base, generations) {
+		if err := b.admin.deleteUser(username); isGone(err) {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, username)
+	}
+	if len(deleted) == 0 {
+		msg := fmt.Sprintf("User not found: [%v]", base)
+		return nil, &rabbitAdminError{broker.ErrCodeGone, errors.New(msg)}
+	}
+	return deleted, nil
+}
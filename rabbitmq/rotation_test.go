@@ -0,0 +1,23 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUserGenerations(t *testing.T) {
+	// The binding b1-1 must not be mistaken for generation 1 of b1
+	if got, want := userGenerations(bindingUser("b1", 0), []int{0}), []string{"u-b1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Generations %v; want %v", got, want)
+	}
+	if got, want := userGenerations(bindingUser("b1-1", 0), []int{2, 1}), []string{"u-b1-1-2", "u-b1-1-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Generations %v; want %v", got, want)
+	}
+	if got, want := managementUser("i1", 3), "m-i1-3"; got != want {
+		t.Errorf("Management user %q; want %q", got, want)
+	}
+}
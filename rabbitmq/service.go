@@ -7,180 +7,283 @@ package rabbitmq
 import (
 	"fmt"
 	"github.com/FreightTrain/cf-rabbitmq-broker/broker"
-	"log"
+	"github.com/nimbus-cloud/rabbit-hole"
+	"io/ioutil"
+	"net/http"
 )
 
+var serviceLog = broker.NewLogger("Service")
+
 // BrokerService implementation for RabbitMQ Server
 type RabbitService struct {
-	opts  ZoneOptions
-	admin *rabbitAdmin
+	opts   ZoneOptions
+	admin  *rabbitAdmin
+	caCert string // PEM handed to bound apps to verify AMQPS connections
+
+	// Returns the generator for a plan's password policy; replaceable so
+	// tests get predictable credentials.
+	passwords func(*broker.PasswordPolicy) (broker.PasswordGenerator, error)
 }
 
 func New(opts ZoneOptions) (*RabbitService, error) {
+	if credentialKeys[opts.Name] {
+		return nil, fmt.Errorf("Zone [%v]: name is reserved for a binding credentials key", opts.Name)
+	}
+	if _, _, err := hashPassword("", opts.PasswordHashing); err != nil {
+		return nil, fmt.Errorf("Zone [%v]: %v", opts.Name, err)
+	}
 	adm, err := getAdminClient(opts, opts.MgmtUser, opts.MgmtPass)
 	if err != nil {
 		return nil, err
 	}
-	return &RabbitService{opts, adm}, nil
+	var caCert string
+	if opts.CACert != "" {
+		pem, err := ioutil.ReadFile(opts.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("Zone [%v]: cannot read CA file: %v", opts.Name, err)
+		}
+		caCert = string(pem)
+	}
+	return &RabbitService{opts, adm, caCert, passwordGenerator}, nil
+}
+
+// Returns the generator for a plan's password policy, or the default one.
+func passwordGenerator(p *broker.PasswordPolicy) (broker.PasswordGenerator, error) {
+	if p == nil {
+		return broker.RandomPasswordGenerator, nil
+	}
+	return broker.NewPasswordGenerator(*p)
+}
+
+func (b *RabbitService) generatePassword(plan PlanDefinition) (string, error) {
+	gen, err := b.passwords(plan.PasswordPolicy)
+	if err != nil {
+		return "", &rabbitAdminError{broker.ErrCodeOther, err}
+	}
+	password, err := gen.GeneratePassword()
+	if err != nil {
+		return "", &rabbitAdminError{broker.ErrCodeOther, err}
+	}
+	return password, nil
 }
 
 func getAdminClient(opts ZoneOptions, username string, password string) (*rabbitAdmin, error) {
-	url := fmt.Sprintf("http://%v:%v", opts.MgmtHost, opts.MgmtPort)
-	adm, err := newRabbitAdmin(url, username, password)
+	transport, err := mgmtTransport(opts)
 	if err != nil {
 		return nil, err
 	}
+	scheme := "http"
+	if transport != nil {
+		scheme = "https"
+	}
+	url := fmt.Sprintf("%v://%v:%v", scheme, opts.MgmtHost, opts.MgmtPort)
+	adm, err := newRabbitAdmin(url, username, password, transport)
+	if err != nil {
+		return nil, err
+	}
+	adm.hashing = opts.PasswordHashing
 	return adm, nil
 }
 
+// Name of the user managing the service instance's vhost. Every credential
+// rotation creates the user of the next generation.
+func managementUser(instanceId string, generation int) string {
+	return userGeneration(fmt.Sprintf("m-%v", instanceId), generation)
+}
+
+// Name of the user created for a single binding, so every bound app gets
+// its own credentials and unbinding one app leaves the others untouched.
+func bindingUser(bindingId string, generation int) string {
+	return userGeneration(fmt.Sprintf("u-%v", bindingId), generation)
+}
+
+func (b *RabbitService) Zone() string {
+	return b.opts.Name
+}
+
 func (b *RabbitService) Catalog() (broker.Catalog, error) {
-	// TODO: Maybe read catalog from a file
-	return broker.Catalog{
-		Services: []broker.Service{
-			broker.Service{
-				Id:          "rabbitmq",
-				Name:        "rabbitmq",
-				Description: "RabbitMQ Message Broker",
-				Bindable:    true,
-				Tags:        []string{"rabbitmq", "messaging"},
-				Plans: []broker.Plan{
-					broker.Plan{
-						Id:          "default",
-						Name:        "default",
-						Description: "Default RabbitMQ plan represented as a unique broker's vhost.",
-					},
-				},
-			},
-		},
-	}, nil
+	return catalog, nil
 }
 
-func (b *RabbitService) Provision(pr broker.ProvisioningRequest) (string, error) {
+func (b *RabbitService) ManagementTransport() http.RoundTripper {
+	if t, err := mgmtTransport(b.opts); err == nil && t != nil {
+		return t
+	}
+	return nil
+}
+
+func (b *RabbitService) Provision(pr broker.ProvisioningRequest) (*broker.Management, error) {
+	plan, err := lookupPlan(pr.PlanId)
+	if err != nil {
+		return nil, err
+	}
+
 	vhost := pr.InstanceId
 	if err := b.admin.createVhost(vhost, false); err != nil {
-		return "", err
+		return nil, err
 	}
-	log.Printf("Service: Virtual host created on %v: [%v]", b.admin.client.Endpoint, vhost)
+	serviceLog.Printf("Virtual host created on %v: [%v]", b.admin.client.Endpoint, vhost)
 
-	username := fmt.Sprintf("m-%v", vhost)
-	password, _ := broker.RandomPasswordGenerator.GeneratePassword()
-	if err := b.admin.createUser(username, password); err != nil {
+	if err := b.applyPlan(vhost, plan); err != nil {
 		b.admin.deleteVhost(vhost)
-		return "", err
+		return nil, err
 	}
-	log.Printf("Service: Management user created on %v: [%v:%v]", b.admin.client.Endpoint, username, password)
+	serviceLog.Printf("Plan [%v] applied on %v: [%v]", pr.PlanId, b.admin.client.Endpoint, vhost)
+
+	username := managementUser(pr.InstanceId, 0)
+	password, err := b.generatePassword(plan)
+	if err != nil {
+		b.admin.deleteVhost(vhost)
+		return nil, err
+	}
+	if err := b.admin.createUser(username, password, plan.userTags()); err != nil {
+		b.admin.deleteVhost(vhost)
+		return nil, err
+	}
+	serviceLog.Printf("Management user created on %v: [%v]", b.admin.client.Endpoint, username)
 
 	if err := b.admin.grantAllPermissionsIn(username, vhost); err != nil {
 		b.admin.deleteUser(username)
 		b.admin.deleteVhost(vhost)
-		return "", err
+		return nil, err
 	}
-	log.Printf("Service: All permissions granted to management user on %v: [%v]", b.admin.client.Endpoint, username)
+	serviceLog.Debugf("All permissions granted to management user on %v: [%v]", b.admin.client.Endpoint, username)
 
-	// Instantiate a new admin client against the other zone, using the mgmt user/pass created earlier
-	mgmtClient, err := getAdminClient(b.opts, username, password)
-	if err != nil {
-		return "", err
+	if err := b.federate(vhost, plan); err != nil {
+		b.deleteFederationUsers(vhost)
+		b.admin.deleteUser(username)
+		b.admin.deleteVhost(vhost)
+		return nil, err
 	}
 
-	for _, zoneOpts := range Opts.Zones {
+	return &broker.Management{Url: b.admin.client.Endpoint, Username: username, Password: password}, nil
+}
 
-		if zoneOpts.Name == b.opts.Name {
-			continue
+// Applies the plan's limits, default queue type and queue policy to the vhost.
+func (b *RabbitService) applyPlan(vhost string, plan PlanDefinition) error {
+	if plan.MaxConnections > 0 {
+		if err := b.admin.setVhostLimit(vhost, "max-connections", plan.MaxConnections); err != nil {
+			return err
 		}
-
-		upstreamName := fmt.Sprintf("f-%v", vhost)
-		upstreamOpts := map[string]interface{}{
-			"uri":            fmt.Sprintf("amqp://%v:%v@%v:%v/%v", zoneOpts.MgmtUser, zoneOpts.MgmtPass, zoneOpts.Host, zoneOpts.Port, vhost),
-			"maxHops":        1,
-			"expires":        36000000,
-			"reconnectDelay": 5,
-			"ackMode":        "on-confirm",
-			"prefetchCount":  1,
+	}
+	if plan.MaxQueues > 0 {
+		if err := b.admin.setVhostLimit(vhost, "max-queues", plan.MaxQueues); err != nil {
+			return err
 		}
-		if err := mgmtClient.setFederationUpstream(vhost, upstreamName, upstreamOpts); err != nil {
+	}
+	if plan.QueueType != "" {
+		if err := b.admin.setVhostDefaultQueueType(vhost, plan.QueueType); err != nil {
+			return err
 		}
-		log.Printf("Service: Federation Upstream set for %v@%v", vhost, upstreamName)
-
-		policyName := fmt.Sprintf("p-%v", vhost)
-		policyOpts := map[string]interface{}{
-			"vhost":    vhost,
-			"pattern":  "^ps\\.",
-			"applyTo":  "all",
-			"name":     policyName,
-			"priority": 0,
-			"definition": map[string]interface{}{
-				"federation-upstream-set": "all",
-			},
+	}
+	if qp := plan.QueuePolicy; qp != nil {
+		pattern := qp.Pattern
+		if pattern == "" {
+			pattern = ".*"
 		}
-		if err := mgmtClient.setFederationPolicy(vhost, policyName, policyOpts); err != nil {
+		policyName := fmt.Sprintf("q-%v", vhost)
+		policy := rabbithole.Policy{
+			Vhost:      vhost,
+			Pattern:    pattern,
+			ApplyTo:    "queues",
+			Name:       policyName,
+			Priority:   qp.Priority,
+			Definition: qp.definition(),
+		}
+		if err := b.admin.setPolicy(vhost, policyName, policy); err != nil {
+			return err
 		}
-		log.Printf("Service: Federation Policy set for %v@%v", vhost, upstreamName)
-
 	}
-
-	dashboardUrl := fmt.Sprintf("http://%v:%v/#/login/%v/%v", b.opts.Host, b.opts.MgmtPort, username, password)
-	log.Printf("Service: Dashboard URL generated: [%v]", dashboardUrl)
-
-	return dashboardUrl, nil
+	return nil
 }
 
-func (b *RabbitService) Deprovision(pr broker.ProvisioningRequest) error {
+func (b *RabbitService) Deprovision(pr broker.ProvisioningRequest, generations []int) error {
 	vhost := pr.InstanceId
-	username := fmt.Sprintf("m-%v", vhost)
-	if err := b.admin.deleteUser(username); err != nil {
+	username := managementUser(pr.InstanceId, 0)
+	userGone := false
+	if deleted, err := b.deleteUserGenerations(username, generations); isGone(err) {
+		userGone = true
+		serviceLog.Printf("Management user already deleted: [%v]", username)
+	} else if err != nil {
 		return err
+	} else {
+		serviceLog.Printf("Management user(s) deleted: %v", deleted)
 	}
-	log.Printf("Service: Management user deleted: [%v]", username)
 
-	//TODO:Should close existing connections from user 'username'???
+	if err := b.deleteFederationUsers(vhost); err != nil {
+		return err
+	}
+
+	closed, err := b.admin.closeConnections(func(c rabbithole.ConnectionInfo) bool {
+		return c.Vhost == vhost
+	}, Opts.CloseReason)
+	if err != nil {
+		return err
+	}
+	serviceLog.Printf("Closed %v connection(s) to virtual host: [%v]", closed, vhost)
 
-	if err := b.admin.deleteVhost(vhost); err != nil {
+	// A previous attempt may have got as far as deleting the user; the
+	// instance is only gone if the vhost is gone as well.
+	if err := b.admin.deleteVhost(vhost); isGone(err) && !userGone {
+		serviceLog.Printf("Virtual host already deleted: [%v]", vhost)
+		return nil
+	} else if err != nil {
 		return err
 	}
-	log.Printf("Service: Virtual host deleted: [%v]", vhost)
+	serviceLog.Printf("Virtual host deleted: [%v]", vhost)
 
 	return nil
 }
 
 func (b *RabbitService) Bind(br broker.BindingRequest) (string, broker.Credentials, string, error) {
+	plan, err := lookupPlan(br.PlanId)
+	if err != nil {
+		return "", nil, "", err
+	}
+
 	vhost := br.InstanceId
 
-	username := fmt.Sprintf("u-%v", vhost)
-	password, _ := broker.RandomPasswordGenerator.GeneratePassword()
-	if err := b.admin.createUser(username, password); err != nil {
+	username := bindingUser(br.BindingId, 0)
+	password, err := b.generatePassword(plan)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if err := b.admin.createUser(username, password, plan.userTags()); err != nil {
 		return "", nil, "", err
 	}
-	log.Printf("Service: User created: [%v]", username)
+	serviceLog.Printf("User created for binding [%v]: [%v]", br.BindingId, username)
 
 	if err := b.admin.grantAllPermissionsIn(username, vhost); err != nil {
 		b.admin.deleteUser(username)
 		return "", nil, "", err
 	}
-	log.Printf("Service: All permissions granted for vhost: [%v] to user: [%v]", vhost, username)
+	serviceLog.Debugf("All permissions granted for vhost: [%v] to user: [%v]", vhost, username)
 
-	amqpUrl := fmt.Sprintf("amqp://%v:%v@%v:%v/%v", username, password, b.opts.Host, b.opts.Port, vhost)
-	log.Printf("Service: AMQP URL generated: [%v]", amqpUrl)
-
-	return b.opts.Name, broker.Credentials{
-		"uri":  amqpUrl,
-		"host": b.opts.Host,
-	}, "", nil
+	return b.opts.Name, b.credentials(vhost, username, password), plan.syslogDrainUrl(br), nil
 }
 
-func (b *RabbitService) Unbind(br broker.BindingRequest) error {
-	vhost := br.InstanceId
-	username := fmt.Sprintf("u-%v", vhost)
+func (b *RabbitService) Unbind(br broker.BindingRequest, generations []int) error {
+	username := bindingUser(br.BindingId, 0)
 
-	log.Printf("Service: Deleting user: [%v]", username)
+	serviceLog.Debugf("Deleting user: [%v]", username)
 
-	err := b.admin.deleteUser(username)
+	deleted, err := b.deleteUserGenerations(username, generations)
 	if err != nil {
 		return err
 	}
-	log.Printf("Service: User deleted: [%v]", username)
+	serviceLog.Printf("User(s) deleted: %v", deleted)
 
-	//TODO:Should close existing connections from user 'username'???
+	users := make(map[string]bool)
+	for _, u := range userGenerations(username, generations) {
+		users[u] = true
+	}
+	closed, err := b.admin.closeConnections(func(c rabbithole.ConnectionInfo) bool {
+		return users[c.User]
+	}, Opts.CloseReason)
+	if err != nil {
+		return err
+	}
+	serviceLog.Printf("Closed %v connection(s) of user: [%v]", closed, username)
 
 	return nil
 }
@@ -0,0 +1,65 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"errors"
+	"github.com/FreightTrain/cf-rabbitmq-broker/broker"
+	"testing"
+)
+
+type fixedGenerator struct {
+	password string
+	err      error
+}
+
+func (g *fixedGenerator) GeneratePassword() (string, error) {
+	return g.password, g.err
+}
+
+func TestGeneratePasswordFollowsPlanPolicy(t *testing.T) {
+	policy := &broker.PasswordPolicy{Length: 32}
+	var got *broker.PasswordPolicy
+	b := &RabbitService{passwords: func(p *broker.PasswordPolicy) (broker.PasswordGenerator, error) {
+		got = p
+		return &fixedGenerator{password: "fixed"}, nil
+	}}
+
+	password, err := b.generatePassword(PlanDefinition{PasswordPolicy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "fixed" || got != policy {
+		t.Errorf("Generated %q for policy %v; want %q for %v", password, got, "fixed", policy)
+	}
+}
+
+func TestGeneratePasswordErrors(t *testing.T) {
+	tests := map[string]func(*broker.PasswordPolicy) (broker.PasswordGenerator, error){
+		"policy": func(*broker.PasswordPolicy) (broker.PasswordGenerator, error) {
+			return nil, errors.New("weak")
+		},
+		"generator": func(*broker.PasswordPolicy) (broker.PasswordGenerator, error) {
+			return &fixedGenerator{err: errors.New("no entropy")}, nil
+		},
+	}
+	for name, passwords := range tests {
+		b := &RabbitService{passwords: passwords}
+		_, err := b.generatePassword(PlanDefinition{})
+		if e, ok := err.(broker.BrokerServiceError); !ok || e.Code() != broker.ErrCodeOther {
+			t.Errorf("%v: error %v; want a broker service error", name, err)
+		}
+	}
+}
+
+func TestPasswordGeneratorDefault(t *testing.T) {
+	g, err := passwordGenerator(nil)
+	if err != nil || g != broker.RandomPasswordGenerator {
+		t.Errorf("passwordGenerator(nil) = %v, %v; want RandomPasswordGenerator", g, err)
+	}
+	if _, err := passwordGenerator(&broker.PasswordPolicy{Alphabet: "a"}); err == nil {
+		t.Errorf("passwordGenerator accepted a one-character alphabet")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package rabbitmq
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// Management API transports by zone name, so all admin clients of a zone
+// share one connection pool and the CA bundle is read only once.
+var mgmtTransports = struct {
+	sync.Mutex
+	byZone map[string]*http.Transport
+}{byZone: make(map[string]*http.Transport)}
+
+// Returns the transport used to reach the zone's management API over HTTPS,
+// or nil if the zone exposes it over plain HTTP.
+func mgmtTransport(opts ZoneOptions) (*http.Transport, error) {
+	if !opts.MgmtTLS {
+		return nil, nil
+	}
+
+	mgmtTransports.Lock()
+	defer mgmtTransports.Unlock()
+
+	if t, ok := mgmtTransports.byZone[opts.Name]; ok {
+		return t, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.MgmtSkipVerify,
+	}
+	if opts.MgmtCACert != "" {
+		pem, err := ioutil.ReadFile(opts.MgmtCACert)
+		if err != nil {
+			return nil, fmt.Errorf("Zone [%v]: cannot read management CA file: %v", opts.Name, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("Zone [%v]: no certificates found in management CA file '%v'", opts.Name, opts.MgmtCACert)
+		}
+		config.RootCAs = pool
+	}
+	if opts.MgmtClientCert != "" || opts.MgmtClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.MgmtClientCert, opts.MgmtClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Zone [%v]: cannot load management client certificate: %v", opts.Name, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if opts.MgmtSkipVerify {
+		serviceLog.Errorf("Zone [%v]: management API certificate is NOT verified; use for testing only", opts.Name)
+	}
+
+	t := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: config}
+	mgmtTransports.byZone[opts.Name] = t
+	return t, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2014, The cf-service-broker Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that
+// can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/FreightTrain/cf-rabbitmq-broker/broker"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Asks the running broker described by the config file to rotate the
+// credentials of a service instance's management user or of a binding.
+func rotate(args []string) {
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	fs.Usage = Usage
+	instance := fs.String("instance", "", "")
+	binding := fs.String("binding", "", "")
+	grace := fs.Duration("grace", 0, "")
+	credentials := fs.String("credentials", "", "")
+	brokerUrl := fs.String("url", "", "")
+	insecure := fs.Bool("insecure", false, "")
+	fs.Parse(args)
+
+	if *instance == "" || fs.NArg() != 1 {
+		Usage()
+	}
+
+	configJson := readConfig(fs.Arg(0))
+	broker.PopulateOptions(configJson["broker"])
+
+	var admin *broker.CredentialOptions
+	for i, c := range broker.Opts.Credentials {
+		if c.Admin && (*credentials == "" || c.Name == *credentials) {
+			admin = &broker.Opts.Credentials[i]
+			break
+		}
+	}
+	if admin == nil {
+		fmt.Printf("No admin credentials configured\n")
+		os.Exit(1)
+	}
+
+	if *brokerUrl == "" {
+		scheme, host := "http", broker.Opts.Host
+		if broker.Opts.TLSCertFile != "" {
+			scheme = "https"
+		}
+		if host == "" || host == "0.0.0.0" {
+			host = "127.0.0.1"
+		}
+		*brokerUrl = fmt.Sprintf("%v://%v:%v", scheme, host, broker.Opts.Port)
+	}
+	path := fmt.Sprintf("/admin/service_instances/%v/rotate", url.PathEscape(*instance))
+	if *binding != "" {
+		path = fmt.Sprintf("/admin/service_instances/%v/service_bindings/%v/rotate", url.PathEscape(*instance), url.PathEscape(*binding))
+	}
+
+	body, _ := json.Marshal(map[string]int{"grace_period": int(*grace / time.Second)})
+	req, err := http.NewRequest("POST", *brokerUrl+path, bytes.NewReader(body))
+	if err != nil {
+		fmt.Printf("Cannot create request; %v\n", err)
+		os.Exit(1)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(admin.Username, admin.Password)
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	if *insecure {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("Cannot reach broker at '%v'; %v\n", *brokerUrl, err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	out, _ := ioutil.ReadAll(resp.Body)
+	fmt.Printf("%s", out)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Printf("Rotation failed: %v\n", resp.Status)
+		os.Exit(1)
+	}
+}